@@ -0,0 +1,328 @@
+package alarm
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+)
+
+//Rule operators
+const (
+	OperatorAbove      = ">"
+	OperatorAboveEqual = ">="
+	OperatorBelow      = "<"
+	OperatorBelowEqual = "<="
+	OperatorEqual      = "=="
+	OperatorNotEqual   = "!="
+	OperatorMask       = "&"       //raised when the field has one of the threshold bits set
+	OperatorMissing    = "missing" //raised when the device or the field is not reported
+)
+
+//Severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityMajor    = "major"
+	SeverityCritical = "critical"
+)
+
+//Event states
+const (
+	StateRaised  = "raised"
+	StateCleared = "cleared"
+)
+
+//Rule condition evaluated on every led or sensor status
+type Rule struct {
+	ID         string  `json:"id"`
+	Device     string  `json:"device"` //led or sensor
+	Field      string  `json:"field"`  //status attribute name
+	Operator   string  `json:"operator"`
+	Threshold  float64 `json:"threshold"`
+	Hysteresis float64 `json:"hysteresis"` //margin to cross back before clearing threshold alarms
+	Count      int     `json:"count"`      //consecutive evaluations before raising
+	Severity   string  `json:"severity"`
+}
+
+//Event alarm raise or clear
+type Event struct {
+	SwitchMac string   `json:"switchMac"`
+	RuleID    string   `json:"ruleId"`
+	Device    string   `json:"device"`
+	Mac       string   `json:"mac"`
+	State     string   `json:"state"`
+	Severity  string   `json:"severity"`
+	Field     string   `json:"field"`
+	Value     *float64 `json:"value,omitempty"`
+	Threshold float64  `json:"threshold"`
+	Date      string   `json:"date"`
+}
+
+//ToJSON dump alarm event struct
+func (e Event) ToJSON() (string, error) {
+	inrec, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Validate return the reason why the rule cannot be evaluated
+func (r Rule) Validate() string {
+	if r.ID == "" {
+		return "missing id"
+	}
+	if r.Device != "led" && r.Device != "sensor" {
+		return "unknown device type " + r.Device
+	}
+	switch r.Operator {
+	case OperatorAbove, OperatorAboveEqual, OperatorBelow, OperatorBelowEqual,
+		OperatorEqual, OperatorNotEqual, OperatorMask:
+		if r.Field == "" {
+			return "missing field"
+		}
+	case OperatorMissing:
+	default:
+		return "unknown operator " + r.Operator
+	}
+	switch r.Severity {
+	case SeverityInfo, SeverityWarning, SeverityMajor, SeverityCritical:
+	default:
+		return "unknown severity " + r.Severity
+	}
+	if r.Hysteresis < 0 || r.Count < 0 {
+		return "negative hysteresis or count"
+	}
+	return ""
+}
+
+type alarmState struct {
+	hits   int
+	raised bool
+}
+
+//Engine evaluate the rules on the device status
+type Engine struct {
+	rules  []Rule
+	states map[string]*alarmState          //rule/mac
+	known  map[string]map[string]time.Time //device type: mac: last time reported
+}
+
+//NewEngine create an engine without rules
+func NewEngine() *Engine {
+	return &Engine{
+		states: make(map[string]*alarmState),
+		known:  make(map[string]map[string]time.Time),
+	}
+}
+
+//SetRules replace the rules, the alarms of the removed or modified rules are cleared
+func (e *Engine) SetRules(rules []Rule) []Event {
+	var events []Event
+	kept := make(map[string]Rule)
+	for _, rule := range rules {
+		kept[rule.ID] = rule
+	}
+	for _, rule := range e.rules {
+		if next, ok := kept[rule.ID]; ok && next == rule {
+			continue
+		}
+		for key, state := range e.states {
+			ruleID, mac := splitKey(key)
+			if ruleID != rule.ID {
+				continue
+			}
+			if state.raised {
+				events = append(events, newEvent(rule, mac, StateCleared, nil))
+			}
+			delete(e.states, key)
+		}
+	}
+	e.rules = rules
+	return events
+}
+
+//Forget stop evaluating a device removed from the switch, its alarms are cleared
+func (e *Engine) Forget(device, mac string) []Event {
+	var events []Event
+	delete(e.known[device], mac)
+	for _, rule := range e.rules {
+		if rule.Device != device {
+			continue
+		}
+		key := rule.ID + "/" + mac
+		if state, ok := e.states[key]; ok && state.raised {
+			events = append(events, newEvent(rule, mac, StateCleared, nil))
+		}
+		delete(e.states, key)
+	}
+	return events
+}
+
+//Expire forget the devices not reported for longer than maxAge, unplugged or lost ones
+func (e *Engine) Expire(maxAge time.Duration) []Event {
+	var events []Event
+	for device, macs := range e.known {
+		for mac, seen := range macs {
+			if time.Since(seen) > maxAge {
+				events = append(events, e.Forget(device, mac)...)
+			}
+		}
+	}
+	return events
+}
+
+//Rules return the current rules
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+//Evaluate apply the rules of the device type on the devices attributes
+func (e *Engine) Evaluate(device string, devices map[string]map[string]interface{}) []Event {
+	var events []Event
+	if _, ok := e.known[device]; !ok {
+		e.known[device] = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for mac := range devices {
+		e.known[device][mac] = now
+	}
+
+	for _, rule := range e.rules {
+		if rule.Device != device {
+			continue
+		}
+		for mac := range e.known[device] {
+			var value *float64
+			attributes, present := devices[mac]
+			if present {
+				value = toFloat(attributes[rule.Field])
+			}
+			if !present && rule.Operator != OperatorMissing {
+				continue
+			}
+			event := e.update(rule, mac, value, present)
+			if event != nil {
+				events = append(events, *event)
+			}
+		}
+	}
+	return events
+}
+
+func (e *Engine) update(rule Rule, mac string, value *float64, present bool) *Event {
+	key := rule.ID + "/" + mac
+	state, ok := e.states[key]
+	if !ok {
+		state = &alarmState{}
+		e.states[key] = state
+	}
+
+	if !state.raised {
+		if !rule.matches(value, present, 0) {
+			state.hits = 0
+			return nil
+		}
+		state.hits++
+		if state.hits < rule.Count {
+			return nil
+		}
+		state.raised = true
+		event := newEvent(rule, mac, StateRaised, value)
+		return &event
+	}
+
+	if rule.matches(value, present, rule.Hysteresis) {
+		return nil
+	}
+	state.raised = false
+	state.hits = 0
+	event := newEvent(rule, mac, StateCleared, value)
+	return &event
+}
+
+//matches evaluate the condition, the margin keeps threshold alarms raised until crossed back
+func (r Rule) matches(value *float64, present bool, margin float64) bool {
+	if r.Operator == OperatorMissing {
+		return !present || (r.Field != "" && value == nil)
+	}
+	if value == nil {
+		return false
+	}
+	v := *value
+	switch r.Operator {
+	case OperatorAbove:
+		return v > r.Threshold-margin
+	case OperatorAboveEqual:
+		return v >= r.Threshold-margin
+	case OperatorBelow:
+		return v < r.Threshold+margin
+	case OperatorBelowEqual:
+		return v <= r.Threshold+margin
+	case OperatorEqual:
+		return v == r.Threshold
+	case OperatorNotEqual:
+		return v != r.Threshold
+	case OperatorMask:
+		return int64(v)&int64(r.Threshold) != 0
+	}
+	return false
+}
+
+func newEvent(rule Rule, mac, state string, value *float64) Event {
+	return Event{
+		RuleID:    rule.ID,
+		Device:    rule.Device,
+		Mac:       mac,
+		State:     state,
+		Severity:  rule.Severity,
+		Field:     rule.Field,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Date:      time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func splitKey(key string) (string, string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
+
+func toFloat(value interface{}) *float64 {
+	var v float64
+	switch typed := value.(type) {
+	case float64:
+		v = typed
+	case bool:
+		if typed {
+			v = 1
+		}
+	case string:
+		parsed, err := strconv.ParseFloat(typed, 64)
+		if err != nil {
+			return nil
+		}
+		v = parsed
+	default:
+		return nil
+	}
+	return &v
+}
+
+//LoadRules read the persisted rules
+func LoadRules(path string) ([]Rule, error) {
+	var rules []Rule
+	err := core.LoadJSON(path, &rules)
+	return rules, err
+}
+
+//SaveRules persist the rules
+func SaveRules(path string, rules []Rule) error {
+	return core.SaveJSON(path, rules)
+}
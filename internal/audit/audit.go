@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/romana/rlog"
+)
+
+//Audit categories
+const (
+	CategoryCommand     = "command"
+	CategoryRejection   = "rejection"
+	CategoryDriver      = "driver"
+	CategoryPackage     = "package"
+	CategoryUpgrade     = "upgrade"
+	CategoryReboot      = "reboot"
+	CategoryService     = "service"
+	CategoryCertificate = "certificate"
+	CategoryCredentials = "credentials"
+
+	maxEntrySize = 4 * 1024 * 1024 //longest line read back from the log
+)
+
+//Entry audit log record
+type Entry struct {
+	Date     string `json:"date"`
+	Category string `json:"category"`
+	Action   string `json:"action"`
+	Identity string `json:"identity,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Details  string `json:"details,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//Query audit log filter
+type Query struct {
+	Since    string `json:"since"`    //RFC3339 date, no lower bound when empty
+	Category string `json:"category"` //every category when empty
+	Limit    int    `json:"limit"`    //keep the last entries only when positive
+}
+
+//ToJSON dump audit entries
+func ToJSON(entries []Entry) (string, error) {
+	inrec, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Logger append only audit log
+type Logger struct {
+	conf  config.AuditConfig
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+//NewLogger open the audit log for appending
+func NewLogger(conf config.AuditConfig) (*Logger, error) {
+	err := os.MkdirAll(filepath.Dir(conf.File), 0750)
+	if err != nil {
+		return nil, err
+	}
+	logger := Logger{
+		conf: conf,
+	}
+	err = logger.open()
+	if err != nil {
+		return nil, err
+	}
+	return &logger, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.conf.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *Logger) rotate() error {
+	l.file.Close()
+	for i := l.conf.MaxFiles - 1; i > 0; i-- {
+		os.Rename(rotatedName(l.conf.File, i), rotatedName(l.conf.File, i+1))
+	}
+	if l.conf.MaxFiles > 0 {
+		os.Rename(l.conf.File, rotatedName(l.conf.File, 1))
+	} else {
+		os.Remove(l.conf.File)
+	}
+	return l.open()
+}
+
+func rotatedName(path string, index int) string {
+	return path + "." + strconv.Itoa(index)
+}
+
+//Record append an entry to the audit log
+func (l *Logger) Record(entry Entry) {
+	if l == nil {
+		return
+	}
+	if entry.Date == "" {
+		entry.Date = time.Now().UTC().Format(time.RFC3339)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		rlog.Error("Cannot dump audit entry " + err.Error())
+		return
+	}
+	line = append(line, '\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.conf.MaxSize > 0 && l.size+int64(len(line)) > l.conf.MaxSize {
+		err = l.rotate()
+		if err != nil {
+			rlog.Error("Cannot rotate audit log " + err.Error())
+			return
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		rlog.Error("Cannot write audit entry " + err.Error())
+	}
+}
+
+//Close the audit log
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+//Read return the audit entries matching the query, oldest first
+func Read(conf config.AuditConfig, query Query) ([]Entry, error) {
+	var since time.Time
+	if query.Since != "" {
+		date, err := time.Parse(time.RFC3339, query.Since)
+		if err != nil {
+			return nil, err
+		}
+		since = date
+	}
+
+	var entries []Entry
+	for i := conf.MaxFiles; i >= 0; i-- {
+		path := conf.File
+		if i > 0 {
+			path = rotatedName(conf.File, i)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+		for scanner.Scan() {
+			var entry Entry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if query.Category != "" && entry.Category != query.Category {
+				continue
+			}
+			if !since.IsZero() {
+				date, err := time.Parse(time.RFC3339, entry.Date)
+				if err != nil || date.Before(since) {
+					continue
+				}
+			}
+			entries = append(entries, entry)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, errors.New("cannot read " + path + ": " + err.Error())
+		}
+	}
+
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+//ValidationConfig server payload validation settings
+type ValidationConfig struct {
+	Strict          bool     `json:"strict"`          //reject payloads containing unknown fields
+	AllowedServices []string `json:"allowedServices"` //services the server may install, any energieip service when empty
+}
+
+//SecurityConfig server command authentication settings
+type SecurityConfig struct {
+	RequireSignature bool   `json:"requireSignature"` //refuse unsigned setup, reload and remove commands
+	TrustStore       string `json:"trustStore"`       //directory containing the trusted <keyId>.pub Ed25519 keys
+	MaxClockSkew     int    `json:"maxClockSkew"`     //in seconds
+}
+
+//AuthorizationConfig server command authorization settings
+type AuthorizationConfig struct {
+	PolicyFile string `json:"policyFile"` //every command is allowed when empty
+}
+
+//AuditConfig audit log settings
+type AuditConfig struct {
+	File     string `json:"file"`
+	MaxSize  int64  `json:"maxSize"`  //in bytes, the log is rotated above this size
+	MaxFiles int    `json:"maxFiles"` //number of rotated files kept
+}
+
+//MetricsConfig prometheus endpoint settings
+type MetricsConfig struct {
+	Address string `json:"address"` //listen address, for example ":9180", disabled when empty
+}
+
+//WatchedService service supervised by the watchdog
+type WatchedService struct {
+	Unit             string `json:"unit"`             //systemd unit
+	HeartbeatTimeout int    `json:"heartbeatTimeout"` //in seconds, heartbeats are not required when 0
+	Devices          string `json:"devices"`          //"led" or "sensor": devices degraded while the service is unhealthy
+}
+
+//WatchdogConfig driver services supervision settings
+type WatchdogConfig struct {
+	Period      int              `json:"period"`      //check period in seconds, disabled when 0
+	MaxFailures int              `json:"maxFailures"` //restart attempts escalated to the server
+	BackoffMax  int              `json:"backoffMax"`  //maximum delay between two restarts in seconds
+	Services    []WatchedService `json:"services"`
+}
+
+//AlarmConfig alarm engine settings
+type AlarmConfig struct {
+	RulesFile   string `json:"rulesFile"`   //rules received from the server
+	ForgetAfter int    `json:"forgetAfter"` //in seconds, devices missing from the status for longer are forgotten, never when 0
+}
+
+//FallbackConfig autonomous mode settings
+type FallbackConfig struct {
+	Timeout       int    `json:"timeout"`       //server loss duration in seconds before applying the scenario, disabled when 0
+	ScenarioFile  string `json:"scenarioFile"`  //group settings received from the server
+	GroupsFile    string `json:"groupsFile"`    //last server group settings, restored when leaving the fallback
+	ServerTopic   string `json:"serverTopic"`   //topic the server publishes periodically, broker loss only when empty
+	ServerTimeout int    `json:"serverTimeout"` //in seconds without message on serverTopic before the server is lost
+}
+
+//ScheduleConfig group schedule settings
+type ScheduleConfig struct {
+	File string `json:"file"` //schedule received from the server
+}
+
+//ShutdownConfig graceful shutdown settings
+type ShutdownConfig struct {
+	Timeout int `json:"timeout"` //in seconds, delay given to the in-flight operation before closing the connections
+}
+
+//ReloadConfig service configuration reload settings
+type ReloadConfig struct {
+	WatchPeriod int `json:"watchPeriod"` //in seconds, the file is not watched when 0 (SIGHUP only)
+}
+
+//LogsConfig core service logs settings
+type LogsConfig struct {
+	BufferLines int `json:"bufferLines"` //last log lines kept in memory
+}
+
+//IdentityConfig switch network identity settings
+type IdentityConfig struct {
+	Interface   string `json:"interface"`   //interface giving the mac and IP, the first running ethernet one when empty
+	SwitchID    string `json:"switchId"`    //identifier used in the topics, derived from the mac when empty
+	CheckPeriod int    `json:"checkPeriod"` //in seconds, IP change detection period, disabled when 0
+}
+
+//ProtocolConfig protocol advertised to the server
+type ProtocolConfig struct {
+	Advertised         string `json:"advertised"`         //derived from the server broker settings when empty
+	CertificateWarning int    `json:"certificateWarning"` //in days, warn the server before a certificate expires
+}
+
+//CertificatesConfig client certificate provisioning settings
+type CertificatesConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Dir             string `json:"dir"`             //key, certificate and previous ones
+	RenewBefore     int    `json:"renewBefore"`     //in days, renewal requested before the expiry
+	RollbackTimeout int    `json:"rollbackTimeout"` //in seconds, delay to reach the server with a new certificate
+}
+
+//SecretsConfig encrypted keystore settings
+type SecretsConfig struct {
+	Keystore string `json:"keystore"` //encrypted secrets
+	KeyFile  string `json:"keyFile"`  //root-only keystore key, generated on first write
+	//in seconds, delay to reach a broker with rotated credentials before restoring the previous ones
+	RotationTimeout int `json:"rotationTimeout"`
+}
+
+//UpdateConfig core service self-update settings
+type UpdateConfig struct {
+	Dir             string `json:"dir"`             //downloaded packages and update state
+	DownloadTimeout int    `json:"downloadTimeout"` //in seconds
+	HealthTimeout   int    `json:"healthTimeout"`   //in seconds, delay for the new version to reach the server
+}
+
+//CoreConfig switch core specific settings
+type CoreConfig struct {
+	Validation    ValidationConfig    `json:"validation"`
+	Security      SecurityConfig      `json:"security"`
+	Authorization AuthorizationConfig `json:"authorization"`
+	Audit         AuditConfig         `json:"audit"`
+	Metrics       MetricsConfig       `json:"metrics"`
+	Watchdog      WatchdogConfig      `json:"watchdog"`
+	Alarm         AlarmConfig         `json:"alarm"`
+	Fallback      FallbackConfig      `json:"fallback"`
+	Schedule      ScheduleConfig      `json:"schedule"`
+	Shutdown      ShutdownConfig      `json:"shutdown"`
+	Reload        ReloadConfig        `json:"reload"`
+	Logs          LogsConfig          `json:"logs"`
+	Identity      IdentityConfig      `json:"identity"`
+	Protocol      ProtocolConfig      `json:"protocol"`
+	Certificates  CertificatesConfig  `json:"certificates"`
+	Secrets       SecretsConfig       `json:"secrets"`
+	Update        UpdateConfig        `json:"update"`
+}
+
+type configFile struct {
+	Core *CoreConfig `json:"core"`
+}
+
+//DefaultCoreConfig return the settings used when the configuration file has no core section
+func DefaultCoreConfig() CoreConfig {
+	return CoreConfig{
+		Security: SecurityConfig{
+			TrustStore:   "/etc/energieip-swh200-core/trust",
+			MaxClockSkew: 300,
+		},
+		Audit: AuditConfig{
+			File:     "/var/log/energieip-swh200-core/audit.log",
+			MaxSize:  1024 * 1024,
+			MaxFiles: 5,
+		},
+		Watchdog: WatchdogConfig{
+			Period:      10,
+			MaxFailures: 3,
+			BackoffMax:  300,
+		},
+		Alarm: AlarmConfig{
+			RulesFile:   "/var/lib/energieip-swh200-core/alarm-rules.json",
+			ForgetAfter: 86400,
+		},
+		Fallback: FallbackConfig{
+			Timeout:       300,
+			ScenarioFile:  "/var/lib/energieip-swh200-core/fallback.json",
+			GroupsFile:    "/var/lib/energieip-swh200-core/groups.json",
+			ServerTimeout: 60,
+		},
+		Schedule: ScheduleConfig{
+			File: "/var/lib/energieip-swh200-core/schedule.json",
+		},
+		Shutdown: ShutdownConfig{
+			Timeout: 30,
+		},
+		Reload: ReloadConfig{
+			WatchPeriod: 5,
+		},
+		Logs: LogsConfig{
+			BufferLines: 1000,
+		},
+		Identity: IdentityConfig{
+			CheckPeriod: 30,
+		},
+		Protocol: ProtocolConfig{
+			CertificateWarning: 30,
+		},
+		Certificates: CertificatesConfig{
+			Dir:             "/var/lib/energieip-swh200-core/pki",
+			RenewBefore:     30,
+			RollbackTimeout: 120,
+		},
+		Secrets: SecretsConfig{
+			Keystore:        "/var/lib/energieip-swh200-core/keystore",
+			KeyFile:         "/etc/energieip-swh200-core/keystore.key",
+			RotationTimeout: 120,
+		},
+		Update: UpdateConfig{
+			Dir:             "/var/lib/energieip-swh200-core/update",
+			DownloadTimeout: 600,
+			HealthTimeout:   300,
+		},
+	}
+}
+
+//ReadCoreConfig parse the core section of the service configuration file
+func ReadCoreConfig(path string) (*CoreConfig, error) {
+	conf := DefaultCoreConfig()
+	if path == "" {
+		return &conf, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := configFile{
+		Core: &conf,
+	}
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
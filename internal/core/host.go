@@ -0,0 +1,225 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	thermalZones = "/sys/class/thermal/thermal_zone*"
+)
+
+//MonitoredDisks mount points reported in the host status
+var MonitoredDisks = []string{"/", "/var"}
+
+//DiskUsage file system usage in bytes
+type DiskUsage struct {
+	Total       uint64  `json:"total"`
+	Free        uint64  `json:"free"`
+	Used        uint64  `json:"used"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+//HostStatus SWH200 host telemetry
+type HostStatus struct {
+	Mac             string                   `json:"mac"`
+	Date            string                   `json:"date"`
+	Load1           float64                  `json:"load1"`
+	Load5           float64                  `json:"load5"`
+	Load15          float64                  `json:"load15"`
+	CPUCount        int                      `json:"cpuCount"`
+	MemTotal        uint64                   `json:"memTotal"`     //in bytes
+	MemAvailable    uint64                   `json:"memAvailable"` //in bytes
+	Disks           map[string]DiskUsage     `json:"disks"`
+	Uptime          int64                    `json:"uptime"`       //in seconds
+	Temperatures    map[string]float64       `json:"temperatures"` //in degree Celsius per thermal zone
+	Kernel          string                   `json:"kernel"`
+	OS              string                   `json:"os"`
+	NTPSynchronized *bool                    `json:"ntpSynchronized,omitempty"`
+	Services        map[string]ServiceHealth `json:"services"`
+	Interfaces      []NetworkInterface       `json:"interfaces"`
+}
+
+//ToJSON dump host status struct
+func (h HostStatus) ToJSON() (string, error) {
+	inrec, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//GetHostStatus collect the host telemetry, unavailable values are left empty
+func GetHostStatus() HostStatus {
+	status := HostStatus{
+		Date:  time.Now().UTC().Format(time.RFC3339),
+		Disks: make(map[string]DiskUsage),
+	}
+	status.Load1, status.Load5, status.Load15 = getLoad()
+	status.CPUCount = getCPUCount()
+	status.MemTotal, status.MemAvailable = getMemory()
+	for _, path := range MonitoredDisks {
+		usage, err := getDiskUsage(path)
+		if err == nil {
+			status.Disks[path] = *usage
+		}
+	}
+	status.Uptime = getUptime()
+	status.Temperatures = getTemperatures()
+	status.Kernel = readLine("/proc/sys/kernel/osrelease")
+	status.OS = getOSRelease()
+	status.NTPSynchronized = getNTPSynchronized()
+	status.Interfaces = GetInterfaces()
+	return status
+}
+
+func readLine(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func getLoad() (float64, float64, float64) {
+	fields := strings.Fields(readLine("/proc/loadavg"))
+	if len(fields) < 3 {
+		return 0, 0, 0
+	}
+	load1, _ := strconv.ParseFloat(fields[0], 64)
+	load5, _ := strconv.ParseFloat(fields[1], 64)
+	load15, _ := strconv.ParseFloat(fields[2], 64)
+	return load1, load5, load15
+}
+
+func getCPUCount() int {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "processor") {
+			count++
+		}
+	}
+	return count
+}
+
+func getMemory() (uint64, uint64) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+	var total, available uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = value * 1024
+		case "MemAvailable:":
+			available = value * 1024
+		}
+	}
+	return total, available
+}
+
+func getDiskUsage(path string) (*DiskUsage, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return nil, err
+	}
+	usage := DiskUsage{
+		Total: stat.Blocks * uint64(stat.Bsize),
+		Free:  stat.Bavail * uint64(stat.Bsize),
+	}
+	usage.Used = usage.Total - stat.Bfree*uint64(stat.Bsize)
+	if usage.Total > 0 {
+		usage.UsedPercent = float64(usage.Used) * 100 / float64(usage.Total)
+	}
+	return &usage, nil
+}
+
+func getUptime() int64 {
+	fields := strings.Fields(readLine("/proc/uptime"))
+	if len(fields) < 1 {
+		return 0
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	return int64(uptime)
+}
+
+func getTemperatures() map[string]float64 {
+	temperatures := make(map[string]float64)
+	zones, _ := filepath.Glob(thermalZones)
+	for _, zone := range zones {
+		value, err := strconv.ParseFloat(readLine(filepath.Join(zone, "temp")), 64)
+		if err != nil {
+			continue
+		}
+		name := readLine(filepath.Join(zone, "type"))
+		if name == "" {
+			name = filepath.Base(zone)
+		}
+		temperatures[name] = value / 1000
+	}
+	return temperatures
+}
+
+func getOSRelease() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "PRETTY_NAME=") {
+			return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), "\"")
+		}
+	}
+	return ""
+}
+
+func getNTPSynchronized() *bool {
+	out, err := exec.Command("timedatectl", "status").CombinedOutput()
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		values := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(values) < 2 {
+			continue
+		}
+		switch strings.TrimSpace(values[0]) {
+		case "System clock synchronized", "NTP synchronized":
+			synchronized := strings.TrimSpace(values[1]) == "yes"
+			return &synchronized
+		}
+	}
+	return nil
+}
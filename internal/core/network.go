@@ -0,0 +1,97 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+//NetworkInterface network interface of the switch
+type NetworkInterface struct {
+	Name      string   `json:"name"`
+	Mac       string   `json:"mac"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+}
+
+//GetInterfaces return the non loopback interfaces
+func GetInterfaces() []NetworkInterface {
+	var result []NetworkInterface
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		info := NetworkInterface{
+			Name: iface.Name,
+			Mac:  iface.HardwareAddr.String(),
+			Up:   iface.Flags&net.FlagUp != 0,
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			info.Addresses = append(info.Addresses, addr.String())
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+//GetIdentity return the mac and IPv4 address of the interface, or of the first running ethernet
+//interface when name is empty. The IP is empty while no address is assigned.
+func GetIdentity(name string) (string, string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", "", err
+	}
+	for _, iface := range interfaces {
+		if name != "" && iface.Name != name {
+			continue
+		}
+		if name == "" && (iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 ||
+			len(iface.HardwareAddr) != 6) {
+			continue
+		}
+		if len(iface.HardwareAddr) != 6 {
+			return "", "", errors.New("interface " + name + " has no ethernet address")
+		}
+		return iface.HardwareAddr.String(), interfaceIPv4(iface), nil
+	}
+	if name != "" {
+		return "", "", errors.New("interface " + name + " not found")
+	}
+	return "", "", errors.New("no running ethernet interface")
+}
+
+func interfaceIPv4(iface net.Interface) string {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
+
+//SwitchID build the switch identifier from the last three bytes of its mac address
+func SwitchID(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	if len(hw) != 6 {
+		return "", errors.New("not an ethernet address " + mac)
+	}
+	return strings.ToUpper(hw.String()[9:]), nil
+}
+
+//ValidSwitchID check an identifier used in the topics
+func ValidSwitchID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/+# ")
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	//PackagePrefix prefix of the energieip debian packages
+	PackagePrefix = "energieip-"
+	//CorePackage debian package of this service
+	CorePackage = PackagePrefix + "swh200-core"
+
+	packageInstalled = "installed"
+)
+
+//ServiceHealth systemd state of a switch service
+type ServiceHealth struct {
+	Unit         string `json:"unit"`
+	ActiveState  string `json:"activeState"`
+	SubState     string `json:"subState"`
+	Restarts     int    `json:"restarts"`
+	Memory       uint64 `json:"memory"` //in bytes
+	LastExitCode int    `json:"lastExitCode"`
+	Since        string `json:"since"`
+}
+
+//GetInstalledPackages return the installed energieip packages and their version
+func GetInstalledPackages() map[string]string {
+	packages := make(map[string]string)
+	cmd := exec.Command("dpkg-query", "-W", "-f=${Package} ${Version} ${db:Status-Status}\n", PackagePrefix+"*")
+	out, err := cmd.Output()
+	if err != nil && len(out) == 0 {
+		return packages
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[2] != packageInstalled {
+			continue
+		}
+		packages[fields[0]] = fields[1]
+	}
+	return packages
+}
+
+//GetServiceHealth query systemd for the unit state
+func GetServiceHealth(unit string) (*ServiceHealth, error) {
+	cmd := exec.Command("systemctl", "show", unit,
+		"--property=ActiveState,SubState,NRestarts,MemoryCurrent,ExecMainStatus,StateChangeTimestamp")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	health := ServiceHealth{
+		Unit: unit,
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		values := strings.SplitN(line, "=", 2)
+		if len(values) < 2 {
+			continue
+		}
+		value := strings.TrimSpace(values[1])
+		switch values[0] {
+		case "ActiveState":
+			health.ActiveState = value
+		case "SubState":
+			health.SubState = value
+		case "NRestarts":
+			health.Restarts, _ = strconv.Atoi(value)
+		case "MemoryCurrent":
+			health.Memory, _ = strconv.ParseUint(value, 10, 64)
+		case "ExecMainStatus":
+			health.LastExitCode, _ = strconv.Atoi(value)
+		case "StateChangeTimestamp":
+			health.Since = value
+		}
+	}
+	return &health, nil
+}
+
+//ServiceAction run a systemctl action (start, stop, restart, enable, disable) on the unit
+func ServiceAction(unit, action string) (string, error) {
+	cmd := exec.Command("systemctl", action, unit)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
+
+//GetServiceLogs return the last journal lines of the unit
+func GetServiceLogs(unit string, lines int) (string, error) {
+	cmd := exec.Command("journalctl", "-u", unit, "-n", strconv.Itoa(lines), "--no-pager", "-o", "short-iso")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
@@ -0,0 +1,43 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//LoadJSON read a state file, a missing file leaves the value untouched
+func LoadJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+//SaveJSON atomically write a state file
+func SaveJSON(path string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, content, 0640)
+}
+
+//WriteFile atomically write a file, its directory is created when missing
+func WriteFile(path string, content []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, content, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
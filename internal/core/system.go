@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"os/exec"
 	"strings"
 
@@ -23,21 +24,21 @@ func GetLastSystemUpgradeDate() string {
 }
 
 //SystemUpgrade check and update system
-func SystemUpgrade() {
+func SystemUpgrade() error {
 	rlog.Info("Check for system Update")
 
 	cmd := exec.Command("apt-get", "update")
 	_, err := cmd.CombinedOutput()
 	if err != nil {
 		rlog.Error("apt-get update finished with " + err.Error())
-		return
+		return errors.New("apt-get update: " + err.Error())
 	}
 
 	cmd = exec.Command("apt-get", "upgrade", "-y")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		rlog.Info("Apt-get dist-upgrade finished with " + err.Error())
-		return
+		return errors.New("apt-get upgrade: " + err.Error())
 	}
 	rlog.Info("Upgrade " + string(output))
 
@@ -45,7 +46,7 @@ func SystemUpgrade() {
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		rlog.Info("Apt-get dist-upgrade finished with " + err.Error())
-		return
+		return errors.New("apt-get dist-upgrade: " + err.Error())
 	}
 	rlog.Info("Dist-Upgrade " + string(output))
 
@@ -53,7 +54,7 @@ func SystemUpgrade() {
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		rlog.Info("Apt-get autoremove finished with " + err.Error())
-		return
+		return errors.New("apt-get autoremove: " + err.Error())
 	}
 	rlog.Info("Autoremove " + string(output))
 
@@ -61,9 +62,10 @@ func SystemUpgrade() {
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		rlog.Info("Apt-get autoremove finished with " + err.Error())
-		return
+		return errors.New("apt-get autoclean: " + err.Error())
 	}
 	rlog.Info("Autoclean " + string(output))
 
 	rlog.Warn("Ask for a system reboot????")
+	return nil
 }
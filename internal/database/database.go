@@ -1,10 +1,13 @@
 package database
 
 import (
+	"time"
+
 	"github.com/energieip/common-database-go/pkg/database"
 	gm "github.com/energieip/common-group-go/pkg/groupmodel"
 	led "github.com/energieip/common-led-go/pkg/driverled"
 	sensor "github.com/energieip/common-sensor-go/pkg/driversensor"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
 	"github.com/romana/rlog"
 )
 
@@ -32,6 +35,7 @@ func ConnectDatabase(ip, port string) (*Database, error) {
 
 //GetSwitchLeds return the switch leds
 func GetSwitchLeds(db Database, switchMac string) map[string]led.Led {
+	defer metrics.DBQueryDuration.ObserveSince(time.Now(), "GetSwitchLeds")
 	leds := make(map[string]led.Led)
 
 	criteria := make(map[string]interface{})
@@ -52,6 +56,7 @@ func GetSwitchLeds(db Database, switchMac string) map[string]led.Led {
 
 //GetSwitchSensors return the switch sensors
 func GetSwitchSensors(db Database, switchMac string) map[string]sensor.Sensor {
+	defer metrics.DBQueryDuration.ObserveSince(time.Now(), "GetSwitchSensors")
 	sensors := make(map[string]sensor.Sensor)
 
 	criteria := make(map[string]interface{})
@@ -72,6 +77,7 @@ func GetSwitchSensors(db Database, switchMac string) map[string]sensor.Sensor {
 
 //GetSensor return the sensor
 func GetSensor(db Database, mac string) *sensor.Sensor {
+	defer metrics.DBQueryDuration.ObserveSince(time.Now(), "GetSensor")
 	criteria := make(map[string]interface{})
 	criteria["Mac"] = mac
 	sensorStored, err := db.GetRecord(sensor.DbStatus, sensor.TableName, criteria)
@@ -87,6 +93,7 @@ func GetSensor(db Database, mac string) *sensor.Sensor {
 
 //GetLed return the led
 func GetLed(db Database, mac string) *led.Led {
+	defer metrics.DBQueryDuration.ObserveSince(time.Now(), "GetLed")
 	criteria := make(map[string]interface{})
 	criteria["Mac"] = mac
 	ledStored, err := db.GetRecord(led.DbStatus, led.TableName, criteria)
@@ -102,6 +109,7 @@ func GetLed(db Database, mac string) *led.Led {
 
 //GetStatusGroup return the switch groups
 func GetStatusGroup(db Database, runGroup map[int]bool) map[int]gm.GroupStatus {
+	defer metrics.DBQueryDuration.ObserveSince(time.Now(), "GetStatusGroup")
 	groups := make(map[int]gm.GroupStatus)
 	groupsStored, err := db.FetchAllRecords(gm.DbStatusName, gm.TableStatusName)
 
@@ -0,0 +1,249 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+)
+
+const (
+	//JournalLines journal lines collected per service
+	JournalLines = 2000
+	//DefaultChunkSize archive bytes per chunk sent to the server
+	DefaultChunkSize = 64 * 1024
+	//MaxChunkSize largest chunk accepted
+	MaxChunkSize = 256 * 1024
+
+	redacted = "***"
+	//logged before the received command payloads
+	logPayload = " payload: "
+)
+
+//AptLogs apt history collected in the archive
+var AptLogs = []string{"/var/log/apt/history.log", "/var/log/apt/term.log"}
+
+//secretKeys configuration keys whose value is redacted, matched in lower case
+var secretKeys = []string{"password", "secret", "token", "privatekey"}
+
+//Sources data gathered for the archive
+type Sources struct {
+	ConfigFile string            //service configuration, redacted
+	Units      []string          //systemd units whose journal is collected
+	Files      map[string][]byte //service data added as is (status dump, logs...)
+}
+
+//Chunk part of an archive sent to the server
+type Chunk struct {
+	Mac    string `json:"mac"`
+	ID     string `json:"id"`
+	Index  int    `json:"index"`
+	Count  int    `json:"count"`
+	Size   int    `json:"size"`   //archive size
+	Sha256 string `json:"sha256"` //archive checksum
+	Data   string `json:"data"`   //base64 encoded
+	Error  string `json:"error,omitempty"`
+}
+
+//ToJSON dump chunk struct
+func (c Chunk) ToJSON() (string, error) {
+	inrec, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Collect build the gzipped tar archive, unavailable sources are reported in errors.txt
+func Collect(src Sources) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	var failures []string
+	now := time.Now()
+	add := func(name string, content []byte) {
+		if err := addFile(tw, name, content, now); err != nil {
+			failures = append(failures, name+": "+err.Error())
+		}
+	}
+
+	if src.ConfigFile != "" {
+		content, err := ioutil.ReadFile(src.ConfigFile)
+		if err != nil {
+			failures = append(failures, "config.json: "+err.Error())
+		} else {
+			add("config.json", Redact(content))
+		}
+	}
+	for name, content := range src.Files {
+		add(name, content)
+	}
+
+	host, _ := json.MarshalIndent(core.GetHostStatus(), "", "  ")
+	add("host.json", host)
+	healths := make(map[string]core.ServiceHealth)
+	for _, unit := range src.Units {
+		health, err := core.GetServiceHealth(unit)
+		if err == nil {
+			healths[unit] = *health
+		}
+		journal, err := core.GetServiceLogs(unit, JournalLines)
+		if err != nil {
+			failures = append(failures, "journal "+unit+": "+err.Error())
+		}
+		//the core journal holds the same command payloads as its logs
+		lines := strings.Split(journal, "\n")
+		for i, line := range lines {
+			lines[i] = RedactLog(line)
+		}
+		add("journals/"+unit+".log", []byte(strings.Join(lines, "\n")))
+	}
+	services, _ := json.MarshalIndent(healths, "", "  ")
+	add("services.json", services)
+	packages, _ := json.MarshalIndent(core.GetInstalledPackages(), "", "  ")
+	add("packages.json", packages)
+
+	for _, path := range AptLogs {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			failures = append(failures, path+": "+err.Error())
+			continue
+		}
+		add("apt/"+filepath.Base(path), content)
+	}
+	add("network.txt", networkInfo())
+
+	if len(failures) > 0 {
+		add("errors.txt", []byte(strings.Join(failures, "\n")+"\n"))
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func addFile(tw *tar.Writer, name string, content []byte, date time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: date,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+//networkInfo interfaces, addresses and routes of the switch
+func networkInfo() []byte {
+	var buf bytes.Buffer
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		buf.WriteString("interfaces: " + err.Error() + "\n")
+	}
+	for _, iface := range interfaces {
+		buf.WriteString(iface.Name + " " + iface.HardwareAddr.String() + " " + iface.Flags.String() + "\n")
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			buf.WriteString("    " + addr.String() + "\n")
+		}
+	}
+	for _, args := range [][]string{{"route"}, {"-6", "route"}, {"neigh"}} {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		buf.WriteString("\n# ip " + strings.Join(args, " ") + "\n")
+		if err != nil {
+			buf.WriteString(err.Error() + "\n")
+		}
+		buf.Write(out)
+	}
+	return buf.Bytes()
+}
+
+//Redact hide the secrets of a JSON configuration, invalid JSON is not included
+func Redact(content []byte) []byte {
+	var conf interface{}
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return []byte("invalid configuration: " + err.Error() + "\n")
+	}
+	out, _ := json.MarshalIndent(redactValue(conf), "", "  ")
+	return out
+}
+
+//RedactLog drop the received command payloads of a log line, they may carry credentials
+func RedactLog(line string) string {
+	index := strings.Index(line, logPayload)
+	if index < 0 {
+		return line
+	}
+	return line[:index+len(logPayload)] + redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, v := range typed {
+			if isSecret(key) {
+				typed[key] = redacted
+				continue
+			}
+			typed[key] = redactValue(v)
+		}
+	case []interface{}:
+		for i, v := range typed {
+			typed[i] = redactValue(v)
+		}
+	}
+	return value
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+//Split cut the archive in chunks of at most size bytes
+func Split(archive []byte, mac, id string, size int) []Chunk {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	sum := sha256.Sum256(archive)
+	count := (len(archive) + size - 1) / size
+	var chunks []Chunk
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(archive) {
+			end = len(archive)
+		}
+		chunks = append(chunks, Chunk{
+			Mac:    mac,
+			ID:     id,
+			Index:  i,
+			Count:  count,
+			Size:   len(archive),
+			Sha256: hex.EncodeToString(sum[:]),
+			Data:   base64.StdEncoding.EncodeToString(archive[i*size : end]),
+		})
+	}
+	return chunks
+}
@@ -0,0 +1,178 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//rlog levels, from the most verbose
+const (
+	LevelTrace    = "TRACE"
+	LevelDebug    = "DEBUG"
+	LevelInfo     = "INFO"
+	LevelWarn     = "WARN"
+	LevelError    = "ERROR"
+	LevelCritical = "CRITICAL"
+	LevelNone     = "NONE" //only accepted as log level, disable the logs
+)
+
+var levels = []string{LevelTrace, LevelDebug, LevelInfo, LevelWarn, LevelError, LevelCritical, LevelNone}
+
+//Line log line kept in the buffer
+type Line struct {
+	Date    string `json:"date"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+//ToJSON dump log line struct
+func (l Line) ToJSON() (string, error) {
+	inrec, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Buffer rlog output keeping the last lines in memory and copying the stream to the console
+type Buffer struct {
+	Streamed chan Line //lines matching the running stream
+	out      io.Writer
+	lines    []Line
+	next     int
+	full     bool
+	partial  []byte
+	stream   int //minimal level index, -1 when not streaming
+	until    time.Time
+	mutex    sync.Mutex
+}
+
+//NewBuffer create a buffer of size lines writing to out
+func NewBuffer(size int, out io.Writer) *Buffer {
+	if size <= 0 {
+		size = 1
+	}
+	return &Buffer{
+		Streamed: make(chan Line, 100),
+		out:      out,
+		lines:    make([]Line, size),
+		stream:   -1,
+	}
+}
+
+//ValidLevel check a level name
+func ValidLevel(level string) bool {
+	return levelIndex(level) >= 0
+}
+
+func levelIndex(level string) int {
+	for i, l := range levels {
+		if strings.HasPrefix(level, l) {
+			return i
+		}
+	}
+	return -1
+}
+
+//Write implement io.Writer for rlog.SetOutput
+func (b *Buffer) Write(p []byte) (int, error) {
+	n, err := b.out.Write(p)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.add(parseLine(string(b.partial[:i])))
+		b.partial = b.partial[i+1:]
+	}
+	return n, err
+}
+
+func (b *Buffer) add(line Line) {
+	if line.Message == "" {
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+	if b.stream < 0 {
+		return
+	}
+	if time.Now().After(b.until) {
+		b.stream = -1
+		return
+	}
+	if levelIndex(line.Level) < b.stream {
+		return
+	}
+	select {
+	case b.Streamed <- line:
+	default:
+		//never block the logger on a slow server
+	}
+}
+
+//parseLine split a rlog line "[date] LEVEL : [caller] message"
+func parseLine(text string) Line {
+	line := Line{
+		Date:    time.Now().UTC().Format(time.RFC3339),
+		Message: strings.TrimSpace(text),
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		return line
+	}
+	prefix := strings.Fields(text[:i])
+	if len(prefix) == 0 || levelIndex(prefix[len(prefix)-1]) < 0 {
+		return line
+	}
+	line.Level = prefix[len(prefix)-1]
+	line.Message = strings.TrimSpace(text[i+2:])
+	return line
+}
+
+//Tail return the last lines of at least the given level, oldest first
+func (b *Buffer) Tail(count int, level string) []Line {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	min := levelIndex(level)
+	var ordered []Line
+	if b.full {
+		ordered = append(ordered, b.lines[b.next:]...)
+	}
+	ordered = append(ordered, b.lines[:b.next]...)
+	var result []Line
+	for i := len(ordered) - 1; i >= 0 && len(result) < count; i-- {
+		if levelIndex(ordered[i].Level) >= min {
+			result = append(result, ordered[i])
+		}
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+//Stream forward the lines of at least the given level on Streamed until the deadline
+func (b *Buffer) Stream(level string, until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stream = levelIndex(level)
+	b.until = until
+}
+
+//StopStream stop the running stream
+func (b *Buffer) StopStream() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stream = -1
+}
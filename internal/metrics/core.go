@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/romana/rlog"
+)
+
+//Switch core service metrics
+var (
+	ServerEvents = NewCounterVec("swh200_core_server_events_total",
+		"Server events accepted per type.", "type")
+	ParseFailures = NewCounterVec("swh200_core_server_parse_failures_total",
+		"Server payloads that could not be parsed per type.", "type")
+	DriverCommands = NewCounterVec("swh200_core_driver_commands_total",
+		"Commands sent to the drivers broker per result.", "result")
+	DumpDuration = NewHistogramVec("swh200_core_dump_duration_seconds",
+		"Time spent building and sending the status dump.", DurationBuckets)
+	DumpSize = NewHistogramVec("swh200_core_dump_size_bytes",
+		"Size of the status dump sent to the server.", SizeBuckets)
+	DBQueryDuration = NewHistogramVec("swh200_core_db_query_duration_seconds",
+		"Database query latency per query.", DurationBuckets, "query")
+	PackageInstalls = NewCounterVec("swh200_core_package_installs_total",
+		"Package installations per package and result.", "package", "result")
+	UpgradeDuration = NewHistogramVec("swh200_core_upgrade_duration_seconds",
+		"System upgrade duration per result.", DurationBuckets, "result")
+	BrokerConnected = NewGaugeVec("swh200_core_broker_connected",
+		"Broker connection state, 1 when connected.", "broker")
+)
+
+//Result labels
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+//Result return the result label matching an error
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+//Serve expose the metrics on /metrics, run it in its own goroutine
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Handler)
+	rlog.Info("Metrics available on " + address + "/metrics")
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		rlog.Error("Metrics endpoint stopped " + err.Error())
+	}
+}
@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/romana/rlog"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+
+	contentType = "text/plain; version=0.0.4"
+)
+
+//Default histogram buckets
+var (
+	DurationBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60, 300, 1800}
+	SizeBuckets     = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registry []metric
+	mutex    sync.Mutex
+)
+
+func register(m metric) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	registry = append(registry, m)
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (f family) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+}
+
+//key join the label values, the sample is dropped when they do not match the labels
+func (f family) key(values []string) (string, bool) {
+	if len(values) != len(f.labels) {
+		rlog.Errorf("Metric %s: %d label values for %d labels, sample dropped", f.name, len(values), len(f.labels))
+		return "", false
+	}
+	return strings.Join(values, "\xff"), true
+}
+
+func (f family) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, label := range f.labels {
+			pairs = append(pairs, label+"=\""+escape(values[i])+"\"")
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+escape(extra[i+1])+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//ValueVec counter or gauge partitioned by labels
+type ValueVec struct {
+	family
+	values map[string]float64
+	mutex  sync.Mutex
+}
+
+func newValueVec(kind, name, help string, labels ...string) *ValueVec {
+	vec := ValueVec{
+		family: family{name: name, help: help, kind: kind, labels: labels},
+		values: make(map[string]float64),
+	}
+	register(&vec)
+	return &vec
+}
+
+//NewCounterVec register a monotonic counter
+func NewCounterVec(name, help string, labels ...string) *ValueVec {
+	return newValueVec(typeCounter, name, help, labels...)
+}
+
+//NewGaugeVec register a gauge
+func NewGaugeVec(name, help string, labels ...string) *ValueVec {
+	return newValueVec(typeGauge, name, help, labels...)
+}
+
+//Inc increment the value by one
+func (v *ValueVec) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+//Add increment the value, the sample is dropped when the labels do not match the metric
+func (v *ValueVec) Add(delta float64, labels ...string) {
+	key, ok := v.key(labels)
+	if !ok {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] += delta
+}
+
+//Set change a gauge value, the value is dropped when the labels do not match the metric
+func (v *ValueVec) Set(value float64, labels ...string) {
+	key, ok := v.key(labels)
+	if !ok {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] = value
+}
+
+func (v *ValueVec) write(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.header(w)
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(key), formatFloat(v.values[key]))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+//HistogramVec histogram partitioned by labels
+type HistogramVec struct {
+	family
+	buckets []float64
+	values  map[string]*histogramValue
+	mutex   sync.Mutex
+}
+
+//NewHistogramVec register a histogram
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	vec := HistogramVec{
+		family:  family{name: name, help: help, kind: typeHistogram, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	register(&vec)
+	return &vec
+}
+
+//Observe add a sample, it is dropped when the labels do not match the metric
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key, ok := h.key(labels)
+	if !ok {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += value
+	hv.count++
+}
+
+//ObserveSince add the elapsed time in seconds since start
+func (h *HistogramVec) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	var keys []string
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), hv.count)
+	}
+}
+
+//WriteTo dump every registered metric in the prometheus text format
+func WriteTo(w io.Writer) {
+	mutex.Lock()
+	metrics := make([]metric, len(registry))
+	copy(metrics, registry)
+	mutex.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+//Handler serve the registered metrics
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	WriteTo(w)
+}
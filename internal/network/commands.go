@@ -0,0 +1,530 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"strconv"
+	"strings"
+
+	gm "github.com/energieip/common-group-go/pkg/groupmodel"
+	genericNetwork "github.com/energieip/common-network-go/pkg/network"
+	"github.com/energieip/swh200-coreservice-go/internal/alarm"
+	"github.com/energieip/swh200-coreservice-go/internal/diagnostics"
+	"github.com/energieip/swh200-coreservice-go/internal/logs"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
+	"github.com/energieip/swh200-coreservice-go/internal/schedule"
+	"github.com/energieip/swh200-coreservice-go/internal/update"
+	"github.com/romana/rlog"
+)
+
+//Service lifecycle actions
+const (
+	ServiceStart   = "start"
+	ServiceStop    = "stop"
+	ServiceRestart = "restart"
+	ServiceEnable  = "enable"
+	ServiceDisable = "disable"
+	ServiceLogs    = "logs"
+
+	EventServiceCommand = "serviceCommand"
+	EventAlarmRules     = "alarmRules"
+	EventFallback       = "fallbackScenario"
+	EventSchedule       = "schedule"
+	EventLogCommand     = "logCommand"
+	EventDiagnostics    = "diagnostics"
+	EventCertificate    = "certificate"
+	EventCredentials    = "credentials"
+	EventCoreUpdate     = "coreUpdate"
+
+	MaxLogLines = 1000
+)
+
+//Log command actions
+const (
+	LogLevel      = "level"  //change the core service log level
+	LogStream     = "stream" //stream the core service logs for a duration
+	LogStreamStop = "stop"
+	LogTail       = "tail" //return the last lines kept in memory
+
+	MaxLogStream = 3600 //in seconds
+)
+
+//ServiceCommand server request on a switch service
+type ServiceCommand struct {
+	ID      string `json:"id"`      //echoed in the result
+	Service string `json:"service"` //service name or debian package name
+	Action  string `json:"action"`
+	Lines   int    `json:"lines"` //number of journal lines for the logs action
+}
+
+//ServiceCommandResult response to a service command
+type ServiceCommandResult struct {
+	Mac     string `json:"mac"`
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	Action  string `json:"action"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Output  string `json:"output,omitempty"`
+}
+
+//ToJSON dump service command result struct
+func (r ServiceCommandResult) ToJSON() (string, error) {
+	inrec, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//LogCommand server request on the core service logs
+type LogCommand struct {
+	ID       string `json:"id"` //echoed in the result
+	Action   string `json:"action"`
+	Level    string `json:"level"`    //new log level, or minimal level of the streamed or returned lines
+	Duration int    `json:"duration"` //stream duration in seconds
+	Lines    int    `json:"lines"`    //number of lines for the tail action
+}
+
+func (cmd LogCommand) validate() []FieldError {
+	var errors []FieldError
+	if cmd.Level != "" && !logs.ValidLevel(cmd.Level) {
+		errors = append(errors, FieldError{Field: "level", Reason: "unknown level " + cmd.Level})
+	}
+	switch cmd.Action {
+	case LogLevel:
+		if cmd.Level == "" {
+			errors = append(errors, FieldError{Field: "level", Reason: "missing level"})
+		}
+	case LogStream:
+		if cmd.Duration <= 0 || cmd.Duration > MaxLogStream {
+			errors = append(errors, FieldError{Field: "duration", Reason: "out of range"})
+		}
+	case LogStreamStop:
+	case LogTail:
+		if cmd.Lines < 0 || cmd.Lines > MaxLogLines {
+			errors = append(errors, FieldError{Field: "lines", Reason: "out of range"})
+		}
+	default:
+		errors = append(errors, FieldError{Field: "action", Reason: "unknown action " + cmd.Action})
+	}
+	return errors
+}
+
+//DiagnosticsRequest server request for a diagnostics archive
+type DiagnosticsRequest struct {
+	ID        string `json:"id"`        //echoed in the chunks
+	ChunkSize int    `json:"chunkSize"` //archive bytes per chunk, default when 0
+}
+
+//CertificateDelivery client certificate signed by the server for the switch request
+type CertificateDelivery struct {
+	Certificate string `json:"certificate"` //PEM certificate followed by its chain
+}
+
+//CredentialsRotation new broker credentials sent by the server
+type CredentialsRotation struct {
+	Broker   string `json:"broker"` //server or local
+	Login    string `json:"login"`  //unchanged when empty
+	Password string `json:"password"`
+}
+
+func (cmd CredentialsRotation) validate() []FieldError {
+	var errors []FieldError
+	if cmd.Broker != BrokerServer && cmd.Broker != BrokerLocal {
+		errors = append(errors, FieldError{Field: "broker", Reason: "unknown broker " + cmd.Broker})
+	}
+	if cmd.Password == "" {
+		errors = append(errors, FieldError{Field: "password", Reason: "missing password"})
+	}
+	return errors
+}
+
+func validateUpdate(req update.Request) []FieldError {
+	var errors []FieldError
+	if req.Version == "" {
+		errors = append(errors, FieldError{Field: "version", Reason: "missing version"})
+	} else if !update.ValidVersion(req.Version) {
+		errors = append(errors, FieldError{Field: "version", Reason: "invalid debian version"})
+	}
+	if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+		errors = append(errors, FieldError{Field: "url", Reason: "not an http(s) url"})
+	}
+	if sum, err := hex.DecodeString(req.Sha256); err != nil || len(sum) != sha256.Size {
+		errors = append(errors, FieldError{Field: "sha256", Reason: "invalid checksum"})
+	}
+	return errors
+}
+
+func (cmd ServiceCommand) validate() []FieldError {
+	var errors []FieldError
+	if cmd.Service == "" {
+		errors = append(errors, FieldError{Field: "service", Reason: "missing service"})
+	}
+	switch cmd.Action {
+	case ServiceStart, ServiceStop, ServiceRestart, ServiceEnable, ServiceDisable:
+	case ServiceLogs:
+		if cmd.Lines < 0 || cmd.Lines > MaxLogLines {
+			errors = append(errors, FieldError{Field: "lines", Reason: "out of range"})
+		}
+	default:
+		errors = append(errors, FieldError{Field: "action", Reason: "unknown action " + cmd.Action})
+	}
+	return errors
+}
+
+//decode parse a command payload, unknown fields are refused in strict mode
+func (net ServerNetwork) decode(eventType string, msg genericNetwork.Message, caller Caller, payload []byte, v interface{}) bool {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if net.Validation.Strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == nil {
+		return true
+	}
+	rlog.Error("Cannot parse "+eventType+" ", err.Error())
+	metrics.ParseFailures.Inc(eventType)
+	net.reject(Rejection{
+		Topic:    msg.Topic(),
+		Command:  eventType,
+		Identity: caller.Identity,
+		Reason:   "invalid payload: " + err.Error(),
+	})
+	return false
+}
+
+func (net ServerNetwork) onServiceCommand(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Service command: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventServiceCommand, msg)
+	if caller == nil {
+		return
+	}
+
+	var cmd ServiceCommand
+	if !net.decode(EventServiceCommand, msg, *caller, payload, &cmd) {
+		return
+	}
+	errors := cmd.validate()
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventServiceCommand,
+			Identity: caller.Identity,
+			Reason:   "invalid service command",
+			Errors:   errors,
+		})
+		return
+	}
+
+	required := CommandService
+	if cmd.Action == ServiceLogs {
+		required = CommandLogs
+	}
+	if !net.authorize(EventServiceCommand, msg, *caller, []string{required}) {
+		return
+	}
+	net.accept(EventServiceCommand, msg, *caller, cmd.Action+" "+cmd.Service)
+	select {
+	case net.Services <- cmd:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onAlarmRules(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Alarm rules: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventAlarmRules, msg)
+	if caller == nil {
+		return
+	}
+
+	var rules []alarm.Rule
+	if !net.decode(EventAlarmRules, msg, *caller, payload, &rules) {
+		return
+	}
+	var errors []FieldError
+	ids := make(map[string]bool)
+	for i, rule := range rules {
+		field := "rules[" + strconv.Itoa(i) + "]"
+		if reason := rule.Validate(); reason != "" {
+			errors = append(errors, FieldError{Field: field, Reason: reason})
+		}
+		if ids[rule.ID] {
+			errors = append(errors, FieldError{Field: field + ".id", Reason: "duplicated id " + rule.ID})
+		}
+		ids[rule.ID] = true
+	}
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventAlarmRules,
+			Identity: caller.Identity,
+			Reason:   "invalid alarm rules",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventAlarmRules, msg, *caller, []string{CommandAlarm}) {
+		return
+	}
+	net.accept(EventAlarmRules, msg, *caller, strconv.Itoa(len(rules))+" rules")
+	select {
+	case net.AlarmRules <- rules:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onFallbackScenario(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Fallback scenario: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventFallback, msg)
+	if caller == nil {
+		return
+	}
+
+	var groups map[int]gm.GroupConfig
+	if !net.decode(EventFallback, msg, *caller, payload, &groups) {
+		return
+	}
+	var errors []FieldError
+	for grID, group := range groups {
+		if grID < 0 || group.Group != grID {
+			errors = append(errors, FieldError{
+				Field:  "groups[" + strconv.Itoa(grID) + "]",
+				Reason: "invalid group identifier",
+			})
+		}
+	}
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventFallback,
+			Identity: caller.Identity,
+			Reason:   "invalid fallback scenario",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventFallback, msg, *caller, []string{CommandDevice}) {
+		return
+	}
+	net.accept(EventFallback, msg, *caller, strconv.Itoa(len(groups))+" groups")
+	select {
+	case net.Fallback <- groups:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onSchedule(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Schedule: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventSchedule, msg)
+	if caller == nil {
+		return
+	}
+
+	var sched schedule.Schedule
+	if !net.decode(EventSchedule, msg, *caller, payload, &sched) {
+		return
+	}
+	var errors []FieldError
+	for field, reason := range sched.Validate() {
+		errors = append(errors, FieldError{Field: field, Reason: reason})
+	}
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventSchedule,
+			Identity: caller.Identity,
+			Reason:   "invalid schedule",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventSchedule, msg, *caller, []string{CommandSchedule}) {
+		return
+	}
+	net.accept(EventSchedule, msg, *caller, strconv.Itoa(len(sched.Entries))+" entries, "+
+		strconv.Itoa(len(sched.Holidays))+" holidays")
+	select {
+	case net.Schedule <- sched:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onLogCommand(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Log command: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventLogCommand, msg)
+	if caller == nil {
+		return
+	}
+
+	var cmd LogCommand
+	if !net.decode(EventLogCommand, msg, *caller, payload, &cmd) {
+		return
+	}
+	errors := cmd.validate()
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventLogCommand,
+			Identity: caller.Identity,
+			Reason:   "invalid log command",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventLogCommand, msg, *caller, []string{CommandLogs}) {
+		return
+	}
+	net.accept(EventLogCommand, msg, *caller, strings.TrimSpace(cmd.Action+" "+cmd.Level))
+	select {
+	case net.Logs <- cmd:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onDiagnostics(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Diagnostics: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventDiagnostics, msg)
+	if caller == nil {
+		return
+	}
+
+	var req DiagnosticsRequest
+	if !net.decode(EventDiagnostics, msg, *caller, payload, &req) {
+		return
+	}
+	if req.ChunkSize < 0 || req.ChunkSize > diagnostics.MaxChunkSize {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventDiagnostics,
+			Identity: caller.Identity,
+			Reason:   "invalid diagnostics request",
+			Errors:   []FieldError{{Field: "chunkSize", Reason: "out of range"}},
+		})
+		return
+	}
+
+	if !net.authorize(EventDiagnostics, msg, *caller, []string{CommandDiagnostics}) {
+		return
+	}
+	net.accept(EventDiagnostics, msg, *caller, "id "+req.ID)
+	select {
+	case net.Diagnostics <- req:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onCertificate(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Certificate: Received topic: " + msg.Topic())
+	payload, caller := net.authenticate(EventCertificate, msg)
+	if caller == nil {
+		return
+	}
+
+	var delivery CertificateDelivery
+	if !net.decode(EventCertificate, msg, *caller, payload, &delivery) {
+		return
+	}
+	block, _ := pem.Decode([]byte(delivery.Certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventCertificate,
+			Identity: caller.Identity,
+			Reason:   "invalid certificate",
+			Errors:   []FieldError{{Field: "certificate", Reason: "no PEM certificate"}},
+		})
+		return
+	}
+
+	if !net.authorize(EventCertificate, msg, *caller, []string{CommandCertificate}) {
+		return
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	net.accept(EventCertificate, msg, *caller, "sha256 "+hex.EncodeToString(fingerprint[:]))
+	select {
+	case net.Certificates <- delivery:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onCredentials(client genericNetwork.Client, msg genericNetwork.Message) {
+	//the payload holds a password, it is never logged
+	rlog.Info("Credentials: Received topic: " + msg.Topic())
+	if net.Verifier == nil {
+		net.reject(Rejection{
+			Topic:   msg.Topic(),
+			Command: EventCredentials,
+			Reason:  "signed command required",
+		})
+		return
+	}
+	payload, caller := net.authenticate(EventCredentials, msg)
+	if caller == nil {
+		return
+	}
+
+	var cmd CredentialsRotation
+	if !net.decode(EventCredentials, msg, *caller, payload, &cmd) {
+		return
+	}
+	errors := cmd.validate()
+	if len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventCredentials,
+			Identity: caller.Identity,
+			Reason:   "invalid credentials",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventCredentials, msg, *caller, []string{CommandCredentials}) {
+		return
+	}
+	net.accept(EventCredentials, msg, *caller, strings.TrimSpace("broker "+cmd.Broker+" "+cmd.Login))
+	select {
+	case net.Credentials <- cmd:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onCoreUpdate(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Core update: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventCoreUpdate, msg)
+	if caller == nil {
+		return
+	}
+
+	var req update.Request
+	if !net.decode(EventCoreUpdate, msg, *caller, payload, &req) {
+		return
+	}
+	if errors := validateUpdate(req); len(errors) > 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventCoreUpdate,
+			Identity: caller.Identity,
+			Reason:   "invalid core update",
+			Errors:   errors,
+		})
+		return
+	}
+
+	if !net.authorize(EventCoreUpdate, msg, *caller, []string{CommandUpgrade}) {
+		return
+	}
+	net.accept(EventCoreUpdate, msg, *caller, "version "+req.Version+" id "+req.ID)
+	select {
+	case net.CoreUpdates <- req:
+	case <-net.ctx.Done():
+	}
+}
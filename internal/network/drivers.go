@@ -0,0 +1,77 @@
+package network
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+
+	genericNetwork "github.com/energieip/common-network-go/pkg/network"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
+	"github.com/romana/rlog"
+)
+
+//Driver events published on the drivers broker as /read/switch/<driver>/event/<type>
+const (
+	DriverHello      = "hello"
+	DriverDiscovered = "discovered"
+	DriverLost       = "lost"
+	DriverError      = "error"
+
+	topicDriverEvent = "/read/switch/+/event/"
+)
+
+//DriverEvent event published by a driver
+type DriverEvent struct {
+	Mac     string `json:"mac,omitempty"` //device concerned by the event
+	Driver  string `json:"driver"`        //driver type (led, sensor...) taken from the topic
+	Type    string `json:"type"`          //event type taken from the topic
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//DriverAlarm driver event forwarded to the server
+type DriverAlarm struct {
+	DriverEvent
+	SwitchMac string `json:"switchMac"`
+}
+
+//ToJSON dump driver alarm struct
+func (a DriverAlarm) ToJSON() (string, error) {
+	inrec, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+func driverCallbacks(net LocalNetwork, callbacks map[string]func(genericNetwork.Client, genericNetwork.Message)) {
+	for _, eventType := range []string{DriverHello, DriverDiscovered, DriverLost, DriverError} {
+		callbacks[topicDriverEvent+eventType] = net.onDriverEvent
+	}
+}
+
+func (net LocalNetwork) onDriverEvent(client genericNetwork.Client, msg genericNetwork.Message) {
+	payload := msg.Payload()
+	rlog.Info("Driver event: Received topic: " + msg.Topic() + " payload: " + string(payload))
+	levels := strings.Split(msg.Topic(), "/")
+	if len(levels) < 3 {
+		return
+	}
+	var event DriverEvent
+	if len(payload) > 0 {
+		err := json.Unmarshal(payload, &event)
+		if err != nil {
+			rlog.Error("Cannot parse driver event ", err.Error())
+			metrics.ParseFailures.Inc("driverEvent")
+			return
+		}
+	}
+	event.Type = levels[len(levels)-1]
+	event.Driver = levels[len(levels)-3]
+	atomic.AddInt32(net.busy, 1)
+	defer atomic.AddInt32(net.busy, -1)
+	select {
+	case net.DriverEvents <- event:
+	case <-net.ctx.Done():
+	}
+}
@@ -1,24 +1,56 @@
 package network
 
 import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	genericNetwork "github.com/energieip/common-network-go/pkg/network"
 	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
 	"github.com/romana/rlog"
 )
 
+const (
+	//TopicHeartbeat heartbeat published by the switch services, the wildcard is the systemd unit
+	TopicHeartbeat = "/read/switch/service/+/heartbeat"
+	//TopicPing loopback topic used to probe the drivers broker
+	TopicPing = "/read/switch/core/ping"
+
+	LocalConnected    = BrokerConnected
+	LocalDisconnected = BrokerDisconnected
+
+	LocalBackoffMax = time.Minute
+
+	localQueueSize = 64 //messages kept while the service is busy
+)
+
 //LocalNetwork network object
 type LocalNetwork struct {
-	Iface genericNetwork.NetworkInterface
+	Iface        genericNetwork.NetworkInterface
+	Heartbeats   chan string
+	States       chan string //LocalConnected or LocalDisconnected
+	DriverEvents chan DriverEvent
+	pongs        chan string
+	busy         *int32          //callbacks waiting for the service, they hold the delivery of pings
+	ctx          context.Context //supervision and events stop once canceled
 }
 
 //CreateLocalNetwork create network server object
-func CreateLocalNetwork() (*LocalNetwork, error) {
+func CreateLocalNetwork(ctx context.Context) (*LocalNetwork, error) {
 	driverBroker, err := genericNetwork.NewNetwork(genericNetwork.MQTT)
 	if err != nil {
 		return nil, err
 	}
 	driversNet := LocalNetwork{
-		Iface: driverBroker,
+		Iface:        driverBroker,
+		Heartbeats:   make(chan string, localQueueSize),
+		States:       make(chan string),
+		DriverEvents: make(chan DriverEvent, localQueueSize),
+		pongs:        make(chan string, 1),
+		busy:         new(int32),
+		ctx:          ctx,
 	}
 	return &driversNet, nil
 
@@ -27,6 +59,9 @@ func CreateLocalNetwork() (*LocalNetwork, error) {
 //LocalConnection connect service to drivers and services broker
 func (net LocalNetwork) LocalConnection(conf pkg.ServiceConfig, clientID, switchMac string) error {
 	cbkLocal := make(map[string]func(genericNetwork.Client, genericNetwork.Message))
+	cbkLocal[TopicHeartbeat] = net.onHeartbeat
+	cbkLocal[TopicPing] = net.onPing
+	driverCallbacks(net, cbkLocal)
 	confLocal := genericNetwork.NetworkConfig{
 		IP:               conf.LocalBroker.IP,
 		Port:             conf.LocalBroker.Port,
@@ -38,17 +73,104 @@ func (net LocalNetwork) LocalConnection(conf pkg.ServiceConfig, clientID, switch
 		ClientKey:        conf.LocalBroker.KeyPath,
 		ServerCertificat: conf.LocalBroker.CaPath,
 	}
-	return net.Iface.Initialize(confLocal)
+	err := net.Iface.Initialize(confLocal)
+	if err == nil {
+		metrics.BrokerConnected.Set(1, BrokerLocal)
+	}
+	return err
+}
+
+func (net LocalNetwork) onHeartbeat(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Debug("Heartbeat: Received topic: " + msg.Topic())
+	levels := strings.Split(msg.Topic(), "/")
+	if len(levels) < 2 {
+		return
+	}
+	atomic.AddInt32(net.busy, 1)
+	defer atomic.AddInt32(net.busy, -1)
+	select {
+	case net.Heartbeats <- levels[len(levels)-2]:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net LocalNetwork) onPing(client genericNetwork.Client, msg genericNetwork.Message) {
+	pong(net.pongs, msg)
+}
+
+//Supervise probe the drivers broker and reconnect when it is lost until ctx is canceled,
+//run it in its own goroutine
+func (net LocalNetwork) Supervise(ctx context.Context, conf pkg.ServiceConfig, clientID, switchMac string) {
+	ticker := time.NewTicker(ProbePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if probeBroker(net.Iface, TopicPing, net.pongs) || ctx.Err() != nil {
+			continue
+		}
+		if atomic.LoadInt32(net.busy) > 0 {
+			//the broker delivers messages, the ping waits behind one the service did not read yet
+			rlog.Warn("Drivers broker probe delayed by the busy service, keep the connection")
+			continue
+		}
+		net.Disconnect()
+		setState(ctx, net.States, LocalDisconnected)
+
+		backoff := time.Second
+		for {
+			rlog.Info("Try to reconnect drivers broker " + conf.LocalBroker.IP)
+			err := net.LocalConnection(conf, clientID, switchMac)
+			if err == nil && ctx.Err() != nil {
+				//superseded while connecting
+				net.Iface.Disconnect()
+				return
+			}
+			if err == nil {
+				break
+			}
+			rlog.Error("Cannot connect to drivers broker " + conf.LocalBroker.IP + " error: " + err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > LocalBackoffMax {
+				backoff = LocalBackoffMax
+			}
+		}
+		rlog.Info(clientID + " reconnected to drivers broker " + conf.LocalBroker.IP)
+		setState(ctx, net.States, LocalConnected)
+	}
+}
+
+//Renew use a new broker interface and states channel: a canceled supervision still connecting or
+//probing the previous ones ends on its own without touching the new connection
+func (net *LocalNetwork) Renew() error {
+	driverBroker, err := genericNetwork.NewNetwork(genericNetwork.MQTT)
+	if err != nil {
+		return err
+	}
+	net.Iface = driverBroker
+	net.States = make(chan string)
+	net.pongs = make(chan string, 1)
+	return nil
 }
 
 //Disconnect from drivers broker
 func (net LocalNetwork) Disconnect() {
 	net.Iface.Disconnect()
+	metrics.BrokerConnected.Set(0, BrokerLocal)
 }
 
 //SendCommand to driver brokers
 func (net LocalNetwork) SendCommand(topic, content string) error {
 	err := net.Iface.SendCommand(topic, content)
+	metrics.DriverCommands.Inc(metrics.Result(err))
 	if err != nil {
 		rlog.Error("Cannot send : " + content + "on: " + topic + " Error: " + err.Error())
 	} else {
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"github.com/energieip/common-switch-go/pkg/deviceswitch"
+)
+
+//Command types subject to authorization
+const (
+	CommandSetup       = "setup"
+	CommandPackages    = "packages"
+	CommandReload      = "reload"
+	CommandRemove      = "remove"
+	CommandUpgrade     = "upgrade"
+	CommandDevice      = "device"
+	CommandService     = "service"
+	CommandLogs        = "logs"
+	CommandAlarm       = "alarm"
+	CommandSchedule    = "schedule"
+	CommandDiagnostics = "diagnostics"
+	CommandCertificate = "certificate"
+	CommandCredentials = "credentials"
+	CommandAudit       = "audit"
+
+	AnonymousIdentity = "anonymous"
+)
+
+//Caller identity and claimed roles of a command emitter
+type Caller struct {
+	Identity string
+	Claimed  []string
+}
+
+//Policy map command types to the roles allowed to run them
+type Policy struct {
+	Commands     map[string][]string `json:"commands"`     //command type: accepted roles, no role required when missing
+	Identities   map[string][]string `json:"identities"`   //signing key identifier: granted roles
+	DefaultRoles []string            `json:"defaultRoles"` //roles granted to any caller
+}
+
+//LoadPolicy parse the local policy file
+func LoadPolicy(path string) (*Policy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+//Roles return the roles of the caller, the claimed roles can only narrow the granted ones
+func (p Policy) Roles(identity string, claimed []string) []string {
+	var granted []string
+	granted = append(granted, p.DefaultRoles...)
+	granted = append(granted, p.Identities[identity]...)
+	if len(claimed) == 0 {
+		return granted
+	}
+	allowed := make(map[string]bool)
+	for _, role := range granted {
+		allowed[role] = true
+	}
+	var roles []string
+	for _, role := range claimed {
+		if allowed[role] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+//Authorize check that the roles allow every given command type
+func (p Policy) Authorize(roles []string, commands []string) error {
+	granted := make(map[string]bool)
+	for _, role := range roles {
+		granted[role] = true
+	}
+	var denied []string
+	for _, command := range commands {
+		accepted, ok := p.Commands[command]
+		if !ok {
+			continue
+		}
+		allowed := false
+		for _, role := range accepted {
+			if granted[role] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			denied = append(denied, command)
+		}
+	}
+	if len(denied) > 0 {
+		return errors.New("not allowed to run " + strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+//RequiredCommands return the command types performed by a server event
+func RequiredCommands(eventType string, switchConf deviceswitch.SwitchConfig) []string {
+	var commands []string
+	devices := len(switchConf.LedsSetup) + len(switchConf.LedsConfig) +
+		len(switchConf.SensorsSetup) + len(switchConf.SensorsConfig) + len(switchConf.Groups)
+
+	switch eventType {
+	case EventServerSetup:
+		commands = append(commands, CommandSetup, CommandUpgrade)
+		if len(switchConf.Services) > 0 {
+			commands = append(commands, CommandPackages)
+		}
+	case EventServerReload:
+		commands = append(commands, CommandReload)
+		if devices > 0 {
+			commands = append(commands, CommandDevice)
+		}
+	case EventServerRemove:
+		commands = append(commands, CommandRemove)
+		if len(switchConf.Services) > 0 {
+			commands = append(commands, CommandPackages)
+		}
+		if devices > 0 {
+			commands = append(commands, CommandDevice)
+		}
+	}
+	return commands
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPolicyRoles(t *testing.T) {
+	policy := Policy{
+		Identities: map[string][]string{
+			"operator": {"reader", "operator"},
+		},
+		DefaultRoles: []string{"reader"},
+	}
+	tests := []struct {
+		name     string
+		identity string
+		claimed  []string
+		want     []string
+	}{
+		{"granted roles", "operator", nil, []string{"reader", "reader", "operator"}},
+		{"default roles", AnonymousIdentity, nil, []string{"reader"}},
+		{"claimed subset", "operator", []string{"reader"}, []string{"reader"}},
+		{"claimed role not granted", "operator", []string{"admin"}, nil},
+		{"claimed roles narrowed", "operator", []string{"admin", "operator"}, []string{"operator"}},
+		{"anonymous claiming a role", AnonymousIdentity, []string{"operator"}, nil},
+		{"unknown identity", "intruder", []string{"admin"}, nil},
+	}
+	for _, test := range tests {
+		roles := policy.Roles(test.identity, test.claimed)
+		if !reflect.DeepEqual(roles, test.want) {
+			t.Errorf("%v: Roles(%q, %v) = %v, want %v", test.name, test.identity, test.claimed, roles, test.want)
+		}
+	}
+}
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := Policy{
+		Commands: map[string][]string{
+			CommandSetup:  {"admin"},
+			CommandReload: {"admin", "operator"},
+		},
+	}
+	tests := []struct {
+		name     string
+		roles    []string
+		commands []string
+		allowed  bool
+	}{
+		{"no role required", nil, []string{CommandDevice}, true},
+		{"accepted role", []string{"operator"}, []string{CommandReload}, true},
+		{"missing role", []string{"operator"}, []string{CommandSetup}, false},
+		{"every command checked", []string{"operator"}, []string{CommandReload, CommandSetup}, false},
+		{"no role", nil, []string{CommandReload}, false},
+	}
+	for _, test := range tests {
+		err := policy.Authorize(test.roles, test.commands)
+		if (err == nil) != test.allowed {
+			t.Errorf("%v: Authorize(%v, %v) = %v", test.name, test.roles, test.commands, err)
+		}
+	}
+}
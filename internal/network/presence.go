@@ -0,0 +1,250 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/romana/rlog"
+)
+
+//Presence states published retained on /read/switch/<mac>/presence
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline" //graceful stop
+	PresenceLost    = "lost"    //last-will published by the broker
+
+	presenceQos     = 1
+	presenceTimeout = 5 * time.Second
+	presenceQuiesce = 250 //ms
+)
+
+//PresenceStatus switch presence message
+type PresenceStatus struct {
+	Mac     string `json:"mac"`
+	State   string `json:"state"`
+	Version string `json:"version"`
+	IP      string `json:"ip"`
+	Date    string `json:"date,omitempty"`
+}
+
+//ToJSON dump presence status struct
+func (p PresenceStatus) ToJSON() (string, error) {
+	inrec, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Presence dedicated server broker connection carrying the switch last-will,
+//the generic network library cannot register a will nor publish retained messages
+type Presence struct {
+	status  PresenceStatus
+	client  mqtt.Client
+	stopped bool //offline published, not reconnected anymore
+	mutex   sync.Mutex
+}
+
+func presenceTopic(switchMac string) string {
+	return "/read/switch/" + switchMac + "/presence"
+}
+
+//NewPresence create the presence of the switch
+func NewPresence(switchMac, ip, version string) *Presence {
+	return &Presence{
+		status: PresenceStatus{
+			Mac:     switchMac,
+			Version: version,
+			IP:      ip,
+		},
+	}
+}
+
+//Connect open the presence connection with its last-will and publish online
+func (p *Presence) Connect(conf pkg.ServiceConfig, clientID string) error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stopped = false
+	return p.connect(conf, clientID)
+}
+
+//Check reconnect the presence when its own connection was lost while the server broker is still
+//reachable, the broker published the last-will meanwhile
+func (p *Presence) Check(conf pkg.ServiceConfig, clientID string) error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped || (p.client != nil && p.client.IsConnected()) {
+		return nil
+	}
+	rlog.Warn("Presence connection lost, reconnect it")
+	return p.connect(conf, clientID)
+}
+
+func (p *Presence) connect(conf pkg.ServiceConfig, clientID string) error {
+	p.disconnect()
+
+	lost := p.status
+	lost.State = PresenceLost
+	will, err := lost.ToJSON()
+	if err != nil {
+		return err
+	}
+	broker := conf.NetworkBroker
+	opts := mqtt.NewClientOptions()
+	opts.SetClientID(clientID + "-presence")
+	opts.SetUsername(broker.Login)
+	opts.SetPassword(broker.Password)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectTimeout(presenceTimeout)
+	opts.SetWill(presenceTopic(p.status.Mac), will, presenceQos, true)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		rlog.Error("Presence connection lost " + err.Error())
+	})
+	if broker.CaPath != "" {
+		tlsConfig, err := brokerTLSConfig(broker)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.AddBroker(brokerURL(broker))
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(presenceTimeout) {
+		return errors.New("presence connection timeout")
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	p.client = client
+	return p.publish(PresenceOnline)
+}
+
+//SetIP update the advertised IP address
+func (p *Presence) SetIP(ip string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status.IP = ip
+	if p.client == nil {
+		return
+	}
+	err := p.publish(PresenceOnline)
+	if err != nil {
+		rlog.Error("Cannot update presence " + err.Error())
+	}
+}
+
+//Offline publish the graceful offline state and close the presence connection
+func (p *Presence) Offline() error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.client == nil {
+		return errors.New("presence not connected")
+	}
+	err := p.publish(PresenceOffline)
+	p.disconnect()
+	p.stopped = true
+	return err
+}
+
+//Disconnect close the presence connection, the broker keeps the last retained state
+func (p *Presence) Disconnect() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.disconnect()
+}
+
+func (p *Presence) disconnect() {
+	if p.client != nil {
+		p.client.Disconnect(presenceQuiesce)
+		p.client = nil
+	}
+}
+
+func (p *Presence) publish(state string) error {
+	status := p.status
+	status.State = state
+	status.Date = time.Now().UTC().Format(time.RFC3339)
+	dump, err := status.ToJSON()
+	if err != nil {
+		return err
+	}
+	token := p.client.Publish(presenceTopic(status.Mac), presenceQos, true, dump)
+	if !token.WaitTimeout(presenceTimeout) {
+		return errors.New("presence publication timeout")
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	rlog.Info("Presence " + state + " published for " + status.Mac)
+	return nil
+}
+
+//brokerURL reach the broker like the commands connection: TLS when its certificate authority is given
+func brokerURL(broker pkg.BrokerConnection) string {
+	if broker.CaPath != "" {
+		return "ssl://" + broker.IP + ":" + broker.Port
+	}
+	return "tcp://" + broker.IP + ":" + broker.Port
+}
+
+//brokerTLSConfig trust the broker certificate authority and present the client certificate
+func brokerTLSConfig(broker pkg.BrokerConnection) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(broker.CaPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate found in " + broker.CaPath)
+	}
+	config := &tls.Config{RootCAs: pool}
+	if broker.KeyPath != "" {
+		cert, err := clientCertificate(broker.KeyPath)
+		if err != nil {
+			return nil, errors.New("client certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+//clientCertificate load the client key with the certificate it bundles, or with the .crt file of
+//the same name
+func clientCertificate(keyPath string) (tls.Certificate, error) {
+	certPath := keyPath
+	content, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if !bytes.Contains(content, []byte("-----BEGIN CERTIFICATE-----")) {
+		certPath = strings.TrimSuffix(keyPath, filepath.Ext(keyPath)) + ".crt"
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
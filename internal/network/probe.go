@@ -0,0 +1,57 @@
+package network
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	genericNetwork "github.com/energieip/common-network-go/pkg/network"
+	"github.com/romana/rlog"
+)
+
+//Broker states
+const (
+	BrokerConnected    = "connected"
+	BrokerDisconnected = "disconnected"
+
+	ProbePeriod  = 10 * time.Second
+	ProbeTimeout = 5 * time.Second
+)
+
+//setState report a broker state change unless the supervision is canceled
+func setState(ctx context.Context, states chan string, state string) {
+	select {
+	case states <- state:
+	case <-ctx.Done():
+	}
+}
+
+func pong(pongs chan string, msg genericNetwork.Message) {
+	select {
+	case pongs <- string(msg.Payload()):
+	default:
+	}
+}
+
+//probeBroker check that a ping published on a topic we are subscribed to comes back
+func probeBroker(iface genericNetwork.NetworkInterface, topic string, pongs chan string) bool {
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 10)
+	err := iface.SendCommand(topic, nonce)
+	if err != nil {
+		rlog.Error("Cannot probe broker on " + topic + " " + err.Error())
+		return false
+	}
+	timeout := time.NewTimer(ProbeTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case pong := <-pongs:
+			if pong == nonce {
+				return true
+			}
+		case <-timeout.C:
+			rlog.Error("Broker did not answer the probe on " + topic)
+			return false
+		}
+	}
+}
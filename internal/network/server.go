@@ -1,12 +1,23 @@
 package network
 
 import (
-	"encoding/json"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	gm "github.com/energieip/common-group-go/pkg/groupmodel"
 	genericNetwork "github.com/energieip/common-network-go/pkg/network"
 	pkg "github.com/energieip/common-service-go/pkg/service"
 	"github.com/energieip/common-switch-go/pkg/deviceswitch"
+	"github.com/energieip/swh200-coreservice-go/internal/alarm"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
+	"github.com/energieip/swh200-coreservice-go/internal/schedule"
+	"github.com/energieip/swh200-coreservice-go/internal/update"
 	"github.com/romana/rlog"
 )
 
@@ -14,34 +25,91 @@ const (
 	EventServerSetup  = "serverSetup"
 	EventServerReload = "serverReload"
 	EventServerRemove = "serverRemove"
+	EventAuditQuery   = "auditQuery"
+
+	BrokerServer = "server"
+	BrokerLocal  = "local"
 )
 
 //ServerNetwork network object
 type ServerNetwork struct {
-	Iface  genericNetwork.NetworkInterface
-	Events chan map[string]deviceswitch.SwitchConfig
+	Iface        genericNetwork.NetworkInterface
+	Mac          string //switch identifier the signed commands must target
+	Events       chan map[string]deviceswitch.SwitchConfig
+	Rejections   chan Rejection
+	Validation   config.ValidationConfig
+	Verifier     *Verifier //nil when unsigned commands are accepted
+	Policy       *Policy   //nil when every command is allowed
+	Audit        *audit.Logger
+	AuditQuery   chan audit.Query
+	Services     chan ServiceCommand
+	AlarmRules   chan []alarm.Rule
+	Fallback     chan map[int]gm.GroupConfig
+	Schedule     chan schedule.Schedule
+	Logs         chan LogCommand
+	Diagnostics  chan DiagnosticsRequest
+	Certificates chan CertificateDelivery
+	Credentials  chan CredentialsRotation
+	CoreUpdates  chan update.Request
+	States       chan string   //BrokerConnected or BrokerDisconnected
+	Presence     *Presence     //nil when the presence is not published
+	ServerTopic  string        //topic published periodically by the server, not subscribed when empty
+	serverSeen   *int64        //unix time in nanoseconds of the last server message
+	protocol     *atomic.Value //protocol of the last established connection
+	pongs        chan string
+	ctx          context.Context //commands are dropped once canceled
 }
 
-//CreateServerNetwork create network server object
-func CreateServerNetwork() (*ServerNetwork, error) {
+//CreateServerNetwork create network server object, it stops forwarding commands when ctx is canceled
+func CreateServerNetwork(ctx context.Context) (*ServerNetwork, error) {
 	serverBroker, err := genericNetwork.NewNetwork(genericNetwork.MQTT)
 	if err != nil {
 		return nil, err
 	}
 	serverNet := ServerNetwork{
-		Iface:  serverBroker,
-		Events: make(chan map[string]deviceswitch.SwitchConfig),
+		Iface:        serverBroker,
+		Events:       make(chan map[string]deviceswitch.SwitchConfig),
+		Rejections:   make(chan Rejection),
+		AuditQuery:   make(chan audit.Query),
+		Services:     make(chan ServiceCommand),
+		AlarmRules:   make(chan []alarm.Rule),
+		Fallback:     make(chan map[int]gm.GroupConfig),
+		Schedule:     make(chan schedule.Schedule),
+		Logs:         make(chan LogCommand),
+		Diagnostics:  make(chan DiagnosticsRequest),
+		Certificates: make(chan CertificateDelivery),
+		Credentials:  make(chan CredentialsRotation),
+		CoreUpdates:  make(chan update.Request),
+		States:       make(chan string),
+		pongs:        make(chan string, 1),
+		serverSeen:   new(int64),
+		protocol:     new(atomic.Value),
+		ctx:          ctx,
 	}
 	return &serverNet, nil
 
 }
 
-//RemoteServerConnection connect service to server broker
-func (net ServerNetwork) RemoteServerConnection(conf pkg.ServiceConfig, clientID, switchMac string) error {
+//RemoteServerConnection connect service to server broker, retry until connected or canceled
+func (net ServerNetwork) RemoteServerConnection(ctx context.Context, conf pkg.ServiceConfig, clientID, switchMac string) error {
 	cbkServer := make(map[string]func(genericNetwork.Client, genericNetwork.Message))
 	cbkServer["/write/switch/"+switchMac+"/setup/config"] = net.onSetup
 	cbkServer["/write/switch/"+switchMac+"/update/settings"] = net.onUpdateSetting
 	cbkServer["/remove/switch/"+switchMac+"/update/settings"] = net.onRemoveSetting
+	cbkServer["/write/switch/"+switchMac+"/audit/query"] = net.onAuditQuery
+	cbkServer["/write/switch/"+switchMac+"/service/command"] = net.onServiceCommand
+	cbkServer["/write/switch/"+switchMac+"/alarm/rules"] = net.onAlarmRules
+	cbkServer["/write/switch/"+switchMac+"/fallback/scenario"] = net.onFallbackScenario
+	cbkServer["/write/switch/"+switchMac+"/schedule"] = net.onSchedule
+	cbkServer["/write/switch/"+switchMac+"/log/command"] = net.onLogCommand
+	cbkServer["/write/switch/"+switchMac+"/diagnostics/request"] = net.onDiagnostics
+	cbkServer["/write/switch/"+switchMac+"/setup/certificate"] = net.onCertificate
+	cbkServer["/write/switch/"+switchMac+"/security/credentials"] = net.onCredentials
+	cbkServer["/write/switch/"+switchMac+"/update/core"] = net.onCoreUpdate
+	cbkServer[serverPingTopic(switchMac)] = net.onPing
+	if net.ServerTopic != "" {
+		cbkServer[net.ServerTopic] = net.onServerMessage
+	}
 
 	confServer := genericNetwork.NetworkConfig{
 		IP:               conf.NetworkBroker.IP,
@@ -58,9 +126,22 @@ func (net ServerNetwork) RemoteServerConnection(conf pkg.ServiceConfig, clientID
 	for {
 		rlog.Info("Try to connect to " + conf.NetworkBroker.IP)
 		err := net.Iface.Initialize(confServer)
+		if err == nil && ctx.Err() != nil {
+			//superseded while connecting
+			net.Iface.Disconnect()
+			return ctx.Err()
+		}
 		if err == nil {
 			rlog.Info(clientID + " connected to server broker " + conf.NetworkBroker.IP)
-			return err
+			net.protocol.Store(connectionProtocol(confServer))
+			metrics.BrokerConnected.Set(1, BrokerServer)
+			//give the server a full timeout to show up
+			net.seen()
+			err = net.Presence.Connect(conf, clientID)
+			if err != nil {
+				rlog.Error("Cannot publish presence on " + conf.NetworkBroker.IP + " error: " + err.Error())
+			}
+			return nil
 		}
 		timer := time.NewTicker(time.Second)
 		rlog.Error("Cannot connect to broker " + conf.NetworkBroker.IP + " error: " + err.Error())
@@ -68,7 +149,11 @@ func (net ServerNetwork) RemoteServerConnection(conf pkg.ServiceConfig, clientID
 
 		select {
 		case <-timer.C:
+			timer.Stop()
 			continue
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
 		}
 	}
 }
@@ -76,51 +161,271 @@ func (net ServerNetwork) RemoteServerConnection(conf pkg.ServiceConfig, clientID
 func (net ServerNetwork) onSetup(client genericNetwork.Client, msg genericNetwork.Message) {
 	payload := msg.Payload()
 	rlog.Info("Switch Setup: Received topic: " + msg.Topic() + " payload: " + string(payload))
-	var switchConf deviceswitch.SwitchConfig
-	err := json.Unmarshal(payload, &switchConf)
-	if err != nil {
-		rlog.Error("Cannot parse config ", err.Error())
-		return
-	}
-
-	event := make(map[string]deviceswitch.SwitchConfig)
-	event[EventServerSetup] = switchConf
-	net.Events <- event
+	net.pushEvent(EventServerSetup, msg)
 }
 
 func (net ServerNetwork) onRemoveSetting(client genericNetwork.Client, msg genericNetwork.Message) {
 	payload := msg.Payload()
 	rlog.Info("Force switch system update onRemoveSetting: Received topic: " + msg.Topic() + " payload: " + string(payload))
-	var switchConf deviceswitch.SwitchConfig
-	err := json.Unmarshal(payload, &switchConf)
+	net.pushEvent(EventServerRemove, msg)
+}
+
+func (net ServerNetwork) onUpdateSetting(client genericNetwork.Client, msg genericNetwork.Message) {
+	payload := msg.Payload()
+	rlog.Info("Force switch system update onSwitchUpdate: Received topic: " + msg.Topic() + " payload: " + string(payload))
+	net.pushEvent(EventServerReload, msg)
+}
+
+func serverPingTopic(switchMac string) string {
+	return "/read/switch/" + switchMac + "/core/ping"
+}
+
+func (net ServerNetwork) onPing(client genericNetwork.Client, msg genericNetwork.Message) {
+	pong(net.pongs, msg)
+}
+
+func (net ServerNetwork) onServerMessage(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Debug("Server message: Received topic: " + msg.Topic())
+	net.seen()
+}
+
+func (net ServerNetwork) seen() {
+	atomic.StoreInt64(net.serverSeen, time.Now().UnixNano())
+}
+
+//Protocol return the protocol of the server connection, empty before the first connection
+func (net ServerNetwork) Protocol() string {
+	protocol, _ := net.protocol.Load().(string)
+	return protocol
+}
+
+//ServerSeen return the date of the last message received from the server
+func (net ServerNetwork) ServerSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(net.serverSeen))
+}
+
+//Supervise connect the server broker, probe it and reconnect when it is lost until ctx is canceled,
+//run it in its own goroutine
+func (net ServerNetwork) Supervise(ctx context.Context, conf pkg.ServiceConfig, clientID, switchMac string) {
+	if net.RemoteServerConnection(ctx, conf, clientID, switchMac) != nil {
+		return
+	}
+	setState(ctx, net.States, BrokerConnected)
+	ticker := time.NewTicker(ProbePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		alive := probeBroker(net.Iface, serverPingTopic(switchMac), net.pongs)
+		if ctx.Err() != nil {
+			continue
+		}
+		if alive {
+			err := net.Presence.Check(conf, clientID)
+			if err != nil {
+				rlog.Error("Cannot publish presence on " + conf.NetworkBroker.IP + " error: " + err.Error())
+			}
+			continue
+		}
+		net.Disconnect()
+		setState(ctx, net.States, BrokerDisconnected)
+		if net.RemoteServerConnection(ctx, conf, clientID, switchMac) != nil {
+			return
+		}
+		setState(ctx, net.States, BrokerConnected)
+	}
+}
+
+//pushEvent authenticate and validate the switch configuration and forward it to the service
+func (net ServerNetwork) pushEvent(eventType string, msg genericNetwork.Message) {
+	payload, caller := net.authenticate(eventType, msg)
+	if caller == nil {
+		return
+	}
+
+	switchConf, err := DecodeSwitchConfig(payload, net.Validation.Strict)
 	if err != nil {
 		rlog.Error("Cannot parse config ", err.Error())
+		metrics.ParseFailures.Inc(eventType)
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  eventType,
+			Identity: caller.Identity,
+			Reason:   "invalid payload: " + err.Error(),
+		})
+		return
+	}
+
+	errors := ValidateSwitchConfig(eventType, switchConf, net.Validation)
+	if len(errors) > 0 {
+		rlog.Errorf("Refuse config on %v: %v invalid fields", msg.Topic(), len(errors))
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  eventType,
+			Identity: caller.Identity,
+			Reason:   "invalid configuration",
+			Errors:   errors,
+		})
 		return
 	}
 
+	if !net.authorize(eventType, msg, *caller, RequiredCommands(eventType, switchConf)) {
+		return
+	}
+
+	net.accept(eventType, msg, *caller, summarizeSwitchConfig(switchConf))
 	event := make(map[string]deviceswitch.SwitchConfig)
-	event[EventServerRemove] = switchConf
-	net.Events <- event
+	event[eventType] = switchConf
+	select {
+	case net.Events <- event:
+	case <-net.ctx.Done():
+	}
 }
 
-func (net ServerNetwork) onUpdateSetting(client genericNetwork.Client, msg genericNetwork.Message) {
+//authenticate open the signed envelope when required and return the payload with its caller
+func (net ServerNetwork) authenticate(eventType string, msg genericNetwork.Message) ([]byte, *Caller) {
 	payload := msg.Payload()
-	rlog.Info("Force switch system update onSwitchUpdate: Received topic: " + msg.Topic() + " payload: " + string(payload))
-	var switchConf deviceswitch.SwitchConfig
-	err := json.Unmarshal(payload, &switchConf)
+	if net.ctx.Err() != nil {
+		rlog.Warn("Shutting down, drop command on " + msg.Topic())
+		return nil, nil
+	}
+	net.seen()
+	caller := Caller{
+		Identity: AnonymousIdentity,
+	}
+	if net.Verifier == nil {
+		return payload, &caller
+	}
+	env, err := net.Verifier.Open(payload, msg.Topic(), net.Mac)
 	if err != nil {
-		rlog.Error("Cannot parse config ", err.Error())
+		rlog.Error("Refuse unauthenticated command on " + msg.Topic() + ": " + err.Error())
+		net.reject(Rejection{
+			Topic:   msg.Topic(),
+			Command: eventType,
+			Reason:  "signature: " + err.Error(),
+		})
+		return nil, nil
+	}
+	caller.Identity = env.KeyID
+	caller.Claimed = env.Roles
+	return env.Payload, &caller
+}
+
+//authorize check the caller roles against the policy, refused commands are reported
+func (net ServerNetwork) authorize(eventType string, msg genericNetwork.Message, caller Caller, commands []string) bool {
+	if net.Policy == nil {
+		return true
+	}
+	roles := net.Policy.Roles(caller.Identity, caller.Claimed)
+	err := net.Policy.Authorize(roles, commands)
+	if err == nil {
+		return true
+	}
+	rlog.Warnf("Access denied: identity=%v roles=%v command=%v topic=%v: %v",
+		caller.Identity, roles, eventType, msg.Topic(), err.Error())
+	net.reject(Rejection{
+		Topic:    msg.Topic(),
+		Command:  eventType,
+		Identity: caller.Identity,
+		Reason:   "access denied: " + err.Error(),
+	})
+	return false
+}
+
+//summarizeSwitchConfig describe the services and the amount of devices of a switch configuration
+func summarizeSwitchConfig(switchConf deviceswitch.SwitchConfig) string {
+	var services []string
+	for name, service := range switchConf.Services {
+		services = append(services, strings.TrimSuffix(name+"="+service.Version, "="))
+	}
+	sort.Strings(services)
+	return "services [" + strings.Join(services, " ") + "]" +
+		" leds " + strconv.Itoa(len(switchConf.LedsSetup)+len(switchConf.LedsConfig)) +
+		" sensors " + strconv.Itoa(len(switchConf.SensorsSetup)+len(switchConf.SensorsConfig)) +
+		" groups " + strconv.Itoa(len(switchConf.Groups))
+}
+
+//accept audit and count a command forwarded to the service, the details summarize the command
+//as payloads may hold whole configurations or secrets
+func (net ServerNetwork) accept(eventType string, msg genericNetwork.Message, caller Caller, details string) {
+	net.Audit.Record(audit.Entry{
+		Category: audit.CategoryCommand,
+		Action:   eventType,
+		Identity: caller.Identity,
+		Target:   msg.Topic(),
+		Details:  details,
+	})
+	metrics.ServerEvents.Inc(eventType)
+}
+
+//reject audit the refused command and report it to the service
+func (net ServerNetwork) reject(rejection Rejection) {
+	net.Audit.Record(audit.Entry{
+		Category: audit.CategoryRejection,
+		Action:   rejection.Command,
+		Identity: rejection.Identity,
+		Target:   rejection.Topic,
+		Error:    rejection.Reason,
+	})
+	select {
+	case net.Rejections <- rejection:
+	case <-net.ctx.Done():
+	}
+}
+
+func (net ServerNetwork) onAuditQuery(client genericNetwork.Client, msg genericNetwork.Message) {
+	rlog.Info("Audit query: Received topic: " + msg.Topic() + " payload: " + string(msg.Payload()))
+	payload, caller := net.authenticate(EventAuditQuery, msg)
+	if caller == nil {
 		return
 	}
 
-	event := make(map[string]deviceswitch.SwitchConfig)
-	event[EventServerReload] = switchConf
-	net.Events <- event
+	var query audit.Query
+	if !net.decode(EventAuditQuery, msg, *caller, payload, &query) {
+		return
+	}
+	if query.Limit < 0 {
+		net.reject(Rejection{
+			Topic:    msg.Topic(),
+			Command:  EventAuditQuery,
+			Identity: caller.Identity,
+			Reason:   "invalid audit query",
+			Errors:   []FieldError{{Field: "limit", Reason: "out of range"}},
+		})
+		return
+	}
+
+	if !net.authorize(EventAuditQuery, msg, *caller, []string{CommandAudit}) {
+		return
+	}
+	net.accept(EventAuditQuery, msg, *caller, strings.TrimSpace(query.Category+" "+query.Since))
+	select {
+	case net.AuditQuery <- query:
+	case <-net.ctx.Done():
+	}
+}
+
+//Renew use a new broker interface and states channel: a canceled supervision still connecting or
+//probing the previous ones ends on its own without touching the new connection
+func (net *ServerNetwork) Renew() error {
+	serverBroker, err := genericNetwork.NewNetwork(genericNetwork.MQTT)
+	if err != nil {
+		return err
+	}
+	net.Iface = serverBroker
+	net.States = make(chan string)
+	net.pongs = make(chan string, 1)
+	return nil
 }
 
 //Disconnect from server
 func (net ServerNetwork) Disconnect() {
+	net.Presence.Disconnect()
 	net.Iface.Disconnect()
+	metrics.BrokerConnected.Set(0, BrokerServer)
 }
 
 //SendCommand to server
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/romana/rlog"
+)
+
+const (
+	trustedKeyExtension = ".pub"
+)
+
+//Envelope signed server command
+type Envelope struct {
+	KeyID     string          `json:"keyId"`
+	Nonce     string          `json:"nonce"`
+	Timestamp int64           `json:"timestamp"` //unix time in seconds
+	Topic     string          `json:"topic"`     //command topic the envelope is signed for
+	Switch    string          `json:"switch"`    //switch identifier the envelope is signed for
+	Roles     []string        `json:"roles"`
+	Signature string          `json:"signature"` //base64 Ed25519 signature
+	Payload   json.RawMessage `json:"payload"`
+}
+
+//SignedContent return the bytes covered by the envelope signature
+func (env Envelope) SignedContent() []byte {
+	header := env.KeyID + "\n" + env.Nonce + "\n" + strconv.FormatInt(env.Timestamp, 10) + "\n" +
+		env.Topic + "\n" + env.Switch + "\n" + strings.Join(env.Roles, ",") + "\n"
+	return append([]byte(header), env.Payload...)
+}
+
+//nonceStore nonces of the accepted commands, shared by a verifier and the one replacing it
+type nonceStore struct {
+	seen  map[string]time.Time
+	keep  time.Duration //longest replay window of the verifiers using it
+	mutex sync.Mutex
+}
+
+//Verifier check server command signatures against the trust store
+type Verifier struct {
+	keys    map[string]ed25519.PublicKey
+	maxSkew time.Duration
+	nonces  *nonceStore
+}
+
+//NewVerifier load the trusted server keys
+func NewVerifier(conf config.SecurityConfig) (*Verifier, error) {
+	keys, err := loadTrustStore(conf.TrustStore)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no trusted key found in " + conf.TrustStore)
+	}
+	return &Verifier{
+		keys:    keys,
+		maxSkew: time.Duration(conf.MaxClockSkew) * time.Second,
+		nonces: &nonceStore{
+			seen: make(map[string]time.Time),
+			keep: 2 * time.Duration(conf.MaxClockSkew) * time.Second,
+		},
+	}, nil
+}
+
+//Equal return true when both verifiers trust the same keys with the same clock skew
+func (v *Verifier) Equal(other *Verifier) bool {
+	if v == nil || other == nil {
+		return v == other
+	}
+	return v.maxSkew == other.maxSkew && reflect.DeepEqual(v.keys, other.keys)
+}
+
+//Inherit share the nonces of the replaced verifier, the commands accepted by either of them
+//cannot be replayed on the other one
+func (v *Verifier) Inherit(previous *Verifier) {
+	if v == nil || previous == nil {
+		return
+	}
+	store := previous.nonces
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if v.nonces.keep > store.keep {
+		store.keep = v.nonces.keep
+	}
+	v.nonces = store
+}
+
+func loadTrustStore(path string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != trustedKeyExtension {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(path, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			rlog.Error("Ignore invalid trusted key " + file.Name())
+			continue
+		}
+		keyID := strings.TrimSuffix(file.Name(), trustedKeyExtension)
+		keys[keyID] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+//Open check the envelope signature, target, freshness and nonce then return it
+func (v *Verifier) Open(payload []byte, topic, switchID string) (*Envelope, error) {
+	var env Envelope
+	err := json.Unmarshal(payload, &env)
+	if err != nil {
+		return nil, errors.New("invalid envelope: " + err.Error())
+	}
+	if env.Nonce == "" || len(env.Payload) == 0 {
+		return nil, errors.New("incomplete envelope")
+	}
+	key, ok := v.keys[env.KeyID]
+	if !ok {
+		return nil, errors.New("unknown key " + env.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return nil, errors.New("invalid signature encoding")
+	}
+	if !ed25519.Verify(key, env.SignedContent(), signature) {
+		return nil, errors.New("bad signature")
+	}
+	if env.Topic != topic {
+		return nil, errors.New("envelope signed for topic " + env.Topic)
+	}
+	if !strings.EqualFold(env.Switch, switchID) {
+		return nil, errors.New("envelope signed for switch " + env.Switch)
+	}
+
+	now := time.Now()
+	date := time.Unix(env.Timestamp, 0)
+	if date.Before(now.Add(-v.maxSkew)) || date.After(now.Add(v.maxSkew)) {
+		return nil, errors.New("expired command")
+	}
+
+	store := v.nonces
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for nonce, seen := range store.seen {
+		if now.Sub(seen) > store.keep {
+			delete(store.seen, nonce)
+		}
+	}
+	nonce := env.KeyID + "/" + env.Nonce
+	if _, ok := store.seen[nonce]; ok {
+		return nil, errors.New("replayed command")
+	}
+	store.seen[nonce] = now
+	return &env, nil
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+)
+
+const (
+	testKeyID  = "server"
+	testTopic  = "/write/switch/setup/config"
+	testSwitch = "AA:BB:CC:DD:EE:FF"
+)
+
+//newTestVerifier return a verifier trusting a generated key and the key to sign with
+func newTestVerifier(t *testing.T, maxSkew int) (*Verifier, ed25519.PrivateKey, func()) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "truststore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, testKeyID+trustedKeyExtension),
+		[]byte(base64.StdEncoding.EncodeToString(public)+"\n"), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	verifier, err := NewVerifier(config.SecurityConfig{TrustStore: dir, MaxClockSkew: maxSkew})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return verifier, private, func() { os.RemoveAll(dir) }
+}
+
+func newTestEnvelope(nonce string) Envelope {
+	return Envelope{
+		KeyID:     testKeyID,
+		Nonce:     nonce,
+		Timestamp: time.Now().Unix(),
+		Topic:     testTopic,
+		Switch:    testSwitch,
+		Roles:     []string{"admin"},
+		Payload:   json.RawMessage(`{"mac":"` + testSwitch + `"}`),
+	}
+}
+
+func seal(t *testing.T, key ed25519.PrivateKey, env Envelope) []byte {
+	env.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, env.SignedContent()))
+	payload, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestVerifierOpen(t *testing.T) {
+	verifier, key, cleanup := newTestVerifier(t, 30)
+	defer cleanup()
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(env *Envelope)
+		key      ed25519.PrivateKey
+		topic    string
+		switchID string
+		err      string //expected error prefix, empty when accepted
+	}{
+		{"valid", nil, key, testTopic, testSwitch, ""},
+		{"switch case", nil, key, testTopic, strings.ToLower(testSwitch), ""},
+		{"other topic", nil, key, "/write/switch/remove/config", testSwitch, "envelope signed for topic"},
+		{"other switch", nil, key, testTopic, "11:22:33:44:55:66", "envelope signed for switch"},
+		{"unknown key", func(env *Envelope) { env.KeyID = "other" }, key, testTopic, testSwitch, "unknown key"},
+		{"untrusted signer", nil, otherKey, testTopic, testSwitch, "bad signature"},
+		{"missing nonce", func(env *Envelope) { env.Nonce = "" }, key, testTopic, testSwitch, "incomplete envelope"},
+		{"too old", func(env *Envelope) { env.Timestamp -= 60 }, key, testTopic, testSwitch, "expired command"},
+		{"in the future", func(env *Envelope) { env.Timestamp += 60 }, key, testTopic, testSwitch, "expired command"},
+		{"within skew", func(env *Envelope) { env.Timestamp -= 20 }, key, testTopic, testSwitch, ""},
+	}
+	for i, test := range tests {
+		env := newTestEnvelope("nonce-" + string(rune('a'+i)))
+		if test.change != nil {
+			test.change(&env)
+		}
+		_, err := verifier.Open(seal(t, test.key, env), test.topic, test.switchID)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: rejected: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%v: accepted", test.name)
+		case test.err != "" && !strings.HasPrefix(err.Error(), test.err):
+			t.Errorf("%v: error %q, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifierTampered(t *testing.T) {
+	verifier, key, cleanup := newTestVerifier(t, 30)
+	defer cleanup()
+
+	tests := []struct {
+		name   string
+		change func(env *Envelope)
+	}{
+		{"roles", func(env *Envelope) { env.Roles = append(env.Roles, "root") }},
+		{"topic", func(env *Envelope) { env.Topic = "/write/switch/remove/config" }},
+		{"switch", func(env *Envelope) { env.Switch = "11:22:33:44:55:66" }},
+		{"payload", func(env *Envelope) { env.Payload = json.RawMessage(`{"mac":"other"}`) }},
+		{"timestamp", func(env *Envelope) { env.Timestamp++ }},
+	}
+	for _, test := range tests {
+		var env Envelope
+		err := json.Unmarshal(seal(t, key, newTestEnvelope("tampered-"+test.name)), &env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.change(&env)
+		payload, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = verifier.Open(payload, env.Topic, env.Switch)
+		if err == nil || err.Error() != "bad signature" {
+			t.Errorf("%v changed: error %v, want bad signature", test.name, err)
+		}
+	}
+}
+
+func TestVerifierReplay(t *testing.T) {
+	verifier, key, cleanup := newTestVerifier(t, 30)
+	defer cleanup()
+
+	payload := seal(t, key, newTestEnvelope("replayed"))
+	if _, err := verifier.Open(payload, testTopic, testSwitch); err != nil {
+		t.Fatalf("first command rejected: %v", err)
+	}
+	if _, err := verifier.Open(payload, testTopic, testSwitch); err == nil || err.Error() != "replayed command" {
+		t.Errorf("replay: error %v, want replayed command", err)
+	}
+}
+
+func TestVerifierInherit(t *testing.T) {
+	verifier, key, cleanup := newTestVerifier(t, 30)
+	defer cleanup()
+	reloaded, _, cleanupReloaded := newTestVerifier(t, 30)
+	defer cleanupReloaded()
+	reloaded.keys = verifier.keys
+
+	payload := seal(t, key, newTestEnvelope("replayed"))
+	if _, err := verifier.Open(payload, testTopic, testSwitch); err != nil {
+		t.Fatalf("first command rejected: %v", err)
+	}
+	//the verifier loaded on reload keeps the nonces of the previous one
+	reloaded.Inherit(verifier)
+	if _, err := reloaded.Open(payload, testTopic, testSwitch); err == nil || err.Error() != "replayed command" {
+		t.Errorf("replay after reload: error %v, want replayed command", err)
+	}
+	fresh := seal(t, key, newTestEnvelope("fresh"))
+	if _, err := reloaded.Open(fresh, testTopic, testSwitch); err != nil {
+		t.Errorf("fresh command after reload rejected: %v", err)
+	}
+	if _, err := verifier.Open(fresh, testTopic, testSwitch); err == nil {
+		t.Errorf("command accepted by the reloaded verifier replayed on the previous one")
+	}
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"time"
+
+	genericNetwork "github.com/energieip/common-network-go/pkg/network"
+	pkg "github.com/energieip/common-service-go/pkg/service"
+)
+
+//Advertised protocols
+const (
+	ProtocolMQTT  = "MQTT"
+	ProtocolMQTTS = "MQTTS"
+)
+
+//CertificateInfo certificate found in the broker TLS files
+type CertificateInfo struct {
+	File        string `json:"file"`
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	NotAfter    string `json:"notAfter"`
+	DaysLeft    int    `json:"daysLeft"`
+	Fingerprint string `json:"fingerprint"` //sha256 of the DER certificate
+	IsCA        bool   `json:"isCA"`
+}
+
+//TLSStatus TLS settings of a broker connection
+type TLSStatus struct {
+	Enabled       bool              `json:"enabled"`
+	CaFingerprint string            `json:"caFingerprint,omitempty"`
+	Certificates  []CertificateInfo `json:"certificates,omitempty"`
+	Errors        []string          `json:"errors,omitempty"`
+}
+
+//connectionProtocol protocol of the connection built from the generic network options, it is
+//always MQTT and TLS is used when the broker certificate is given
+func connectionProtocol(conf genericNetwork.NetworkConfig) string {
+	if conf.ServerCertificat != "" {
+		return ProtocolMQTTS
+	}
+	return ProtocolMQTT
+}
+
+//GetTLSStatus read the certificates of the broker CA and client key files
+func GetTLSStatus(broker pkg.BrokerConnection) TLSStatus {
+	status := TLSStatus{
+		Enabled: broker.CaPath != "",
+	}
+	for _, path := range []string{broker.CaPath, broker.KeyPath} {
+		if path == "" {
+			continue
+		}
+		certs, err := readCertificates(path)
+		if err != nil {
+			status.Errors = append(status.Errors, path+": "+err.Error())
+			continue
+		}
+		for _, cert := range certs {
+			info := certificateInfo(path, cert)
+			if path == broker.CaPath && status.CaFingerprint == "" {
+				status.CaFingerprint = info.Fingerprint
+			}
+			status.Certificates = append(status.Certificates, info)
+		}
+	}
+	return status
+}
+
+//Expiring return the certificates expiring within days
+func (t TLSStatus) Expiring(days int) []CertificateInfo {
+	var expiring []CertificateInfo
+	for _, cert := range t.Certificates {
+		if cert.DaysLeft <= days {
+			expiring = append(expiring, cert)
+		}
+	}
+	return expiring
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+func certificateInfo(path string, cert *x509.Certificate) CertificateInfo {
+	sum := sha256.Sum256(cert.Raw)
+	return CertificateInfo{
+		File:        path,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		NotAfter:    cert.NotAfter.UTC().Format(time.RFC3339),
+		DaysLeft:    int(time.Until(cert.NotAfter).Hours() / 24),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		IsCA:        cert.IsCA,
+	}
+}
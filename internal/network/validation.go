@@ -0,0 +1,144 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/energieip/common-switch-go/pkg/deviceswitch"
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+)
+
+const (
+	servicePackagePrefix = "energieip-"
+)
+
+var macPattern = regexp.MustCompile(`^[0-9A-Fa-f]{2}(:[0-9A-Fa-f]{2}){2,7}$`)
+
+//FieldError describe why a payload field has been refused
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+//Rejection report sent back to the server when a command is refused
+type Rejection struct {
+	Mac      string       `json:"mac"`
+	Topic    string       `json:"topic"`
+	Command  string       `json:"command"`
+	Identity string       `json:"identity,omitempty"`
+	Reason   string       `json:"reason"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+//ToJSON dump rejection struct
+func (r Rejection) ToJSON() (string, error) {
+	inrec, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//DecodeSwitchConfig parse a server payload, unknown fields are refused in strict mode
+func DecodeSwitchConfig(payload []byte, strict bool) (deviceswitch.SwitchConfig, error) {
+	var switchConf deviceswitch.SwitchConfig
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(&switchConf)
+	return switchConf, err
+}
+
+//ValidateSwitchConfig check the switch configuration content before any driver is involved
+func ValidateSwitchConfig(eventType string, switchConf deviceswitch.SwitchConfig, rules config.ValidationConfig) []FieldError {
+	var errors []FieldError
+	leds := make(map[string]bool)
+	sensors := make(map[string]bool)
+
+	for mac, led := range switchConf.LedsSetup {
+		errors = append(errors, validateDevice("LedsSetup", mac, led.Mac)...)
+		leds[strings.ToUpper(mac)] = true
+	}
+	for mac, led := range switchConf.LedsConfig {
+		errors = append(errors, validateDevice("LedsConfig", mac, led.Mac)...)
+		leds[strings.ToUpper(mac)] = true
+	}
+	for mac, sensor := range switchConf.SensorsSetup {
+		errors = append(errors, validateDevice("SensorsSetup", mac, sensor.Mac)...)
+		sensors[strings.ToUpper(mac)] = true
+	}
+	for mac, sensor := range switchConf.SensorsConfig {
+		errors = append(errors, validateDevice("SensorsConfig", mac, sensor.Mac)...)
+		sensors[strings.ToUpper(mac)] = true
+	}
+	for mac := range leds {
+		if _, ok := sensors[mac]; ok {
+			errors = append(errors, FieldError{
+				Field:  "Leds[" + mac + "]",
+				Reason: "device declared both as led and sensor",
+			})
+		}
+	}
+
+	for grID, group := range switchConf.Groups {
+		field := "Groups[" + strconv.Itoa(grID) + "]"
+		if grID < 0 {
+			errors = append(errors, FieldError{Field: field, Reason: "negative group identifier"})
+		}
+		if group.Group != grID {
+			errors = append(errors, FieldError{
+				Field:  field + ".Group",
+				Reason: fmt.Sprintf("group %v does not match key %v", group.Group, grID),
+			})
+		}
+	}
+
+	allowed := make(map[string]bool)
+	for _, name := range rules.AllowedServices {
+		allowed[name] = true
+	}
+	for name, service := range switchConf.Services {
+		field := "Services[" + name + "]"
+		if service.Name != name {
+			errors = append(errors, FieldError{
+				Field:  field + ".Name",
+				Reason: "name " + service.Name + " does not match key " + name,
+			})
+		}
+		if len(allowed) > 0 {
+			if _, ok := allowed[name]; !ok {
+				errors = append(errors, FieldError{Field: field, Reason: "unknown service"})
+			}
+		} else if !strings.HasPrefix(service.PackageName, servicePackagePrefix) {
+			errors = append(errors, FieldError{
+				Field:  field + ".PackageName",
+				Reason: "package " + service.PackageName + " is not an energieip package",
+			})
+		}
+		//removed services are identified by their name only
+		if eventType == EventServerSetup && service.Version == "" {
+			errors = append(errors, FieldError{Field: field + ".Version", Reason: "missing version"})
+		}
+	}
+	return errors
+}
+
+func validateDevice(section, key, mac string) []FieldError {
+	var errors []FieldError
+	field := section + "[" + key + "]"
+	if !macPattern.MatchString(key) {
+		errors = append(errors, FieldError{Field: field, Reason: "invalid mac address " + key})
+	}
+	if mac != "" && !strings.EqualFold(mac, key) {
+		errors = append(errors, FieldError{
+			Field:  field + ".Mac",
+			Reason: "mac " + mac + " does not match key " + key,
+		})
+	}
+	return errors
+}
@@ -0,0 +1,206 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+)
+
+const (
+	keyFile        = "key.pem"
+	certFile       = "cert.pem"
+	bundleFile     = "client.pem" //certificate followed by its key, given to the broker connections
+	pendingKeyFile = "pending-key.pem"
+	previousSuffix = ".prev"
+
+	pemCertificate = "CERTIFICATE"
+	pemKey         = "EC PRIVATE KEY"
+)
+
+//Store switch client certificate files
+type Store struct {
+	dir string
+}
+
+//NewStore create a store in dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (st *Store) path(name string) string {
+	return filepath.Join(st.dir, name)
+}
+
+//BundlePath file holding the certificate and its key
+func (st *Store) BundlePath() string {
+	return st.path(bundleFile)
+}
+
+//Certificate return the installed certificate, nil when not provisioned yet
+func (st *Store) Certificate() (*x509.Certificate, error) {
+	content, err := ioutil.ReadFile(st.path(certFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseCertificate(content)
+}
+
+//NeedsCertificate check if the certificate is missing, invalid or expires within renewBefore
+func (st *Store) NeedsCertificate(renewBefore time.Duration) bool {
+	cert, err := st.Certificate()
+	if err != nil || cert == nil {
+		return true
+	}
+	return time.Now().Add(renewBefore).After(cert.NotAfter)
+}
+
+//CreateRequest return a PEM certificate signing request, the pending key is kept until the
+//certificate is installed
+func (st *Store) CreateRequest(commonName string) ([]byte, error) {
+	key, err := st.pendingKey()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{"energieip"},
+		},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+//pendingKey load or generate the key of the next certificate
+func (st *Store) pendingKey() (*ecdsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(st.path(pendingKeyFile))
+	if err == nil {
+		return parseKey(content)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = core.WriteFile(st.path(pendingKeyFile), encoded, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//Install check the certificate against the pending key and install it, the current files are
+//kept for rollback
+func (st *Store) Install(certPEM []byte) (*x509.Certificate, error) {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("certificate not valid now")
+	}
+	keyPEM, err := ioutil.ReadFile(st.path(pendingKeyFile))
+	if err != nil {
+		return nil, errors.New("no pending key: " + err.Error())
+	}
+	key, err := parseKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pendingKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(certKey, pendingKey) {
+		return nil, errors.New("certificate does not match the requested key")
+	}
+
+	for _, name := range []string{keyFile, certFile, bundleFile} {
+		err = os.Rename(st.path(name), st.path(name)+previousSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err = core.WriteFile(st.path(keyFile), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err = core.WriteFile(st.path(certFile), certPEM, 0644); err != nil {
+		return nil, err
+	}
+	if err = core.WriteFile(st.path(bundleFile), append(append([]byte{}, certPEM...), keyPEM...), 0600); err != nil {
+		return nil, err
+	}
+	os.Remove(st.path(pendingKeyFile))
+	return cert, nil
+}
+
+//Rollback restore the previous certificate, the store is emptied when there was none
+func (st *Store) Rollback() error {
+	for _, name := range []string{keyFile, certFile, bundleFile} {
+		err := os.Rename(st.path(name+previousSuffix), st.path(name))
+		if os.IsNotExist(err) {
+			err = os.Remove(st.path(name))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseCertificate(content []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == pemCertificate {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func parseKey(content []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != pemKey {
+		return nil, errors.New("no key found")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemKey, Bytes: der}), nil
+}
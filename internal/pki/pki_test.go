@@ -0,0 +1,162 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(dir), func() { os.RemoveAll(dir) }
+}
+
+//issue return a PEM self-signed certificate for the public key
+func issue(t *testing.T, public crypto.PublicKey, notBefore, notAfter time.Time) []byte {
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "switch"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, public, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemCertificate, Bytes: der})
+}
+
+//requestKey create a signing request and return the public key of the pending key
+func requestKey(t *testing.T, st *Store) crypto.PublicKey {
+	if _, err := st.CreateRequest("switch"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := st.pendingKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Public()
+}
+
+func TestInstallChecks(t *testing.T) {
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request bool
+		cert    func(pending crypto.PublicKey) []byte
+		err     string
+	}{
+		{"matching key", true, func(pending crypto.PublicKey) []byte {
+			return issue(t, pending, now.Add(-time.Hour), now.Add(time.Hour))
+		}, ""},
+		{"other key", true, func(pending crypto.PublicKey) []byte {
+			return issue(t, other.Public(), now.Add(-time.Hour), now.Add(time.Hour))
+		}, "certificate does not match the requested key"},
+		{"expired", true, func(pending crypto.PublicKey) []byte {
+			return issue(t, pending, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		}, "certificate not valid now"},
+		{"not valid yet", true, func(pending crypto.PublicKey) []byte {
+			return issue(t, pending, now.Add(time.Hour), now.Add(2*time.Hour))
+		}, "certificate not valid now"},
+		{"no request", false, func(pending crypto.PublicKey) []byte {
+			return issue(t, other.Public(), now.Add(-time.Hour), now.Add(time.Hour))
+		}, "no pending key"},
+		{"not a certificate", true, func(pending crypto.PublicKey) []byte {
+			return []byte("garbage")
+		}, "no certificate found"},
+	}
+	for _, test := range tests {
+		st, cleanup := newTestStore(t)
+		var pending crypto.PublicKey
+		if test.request {
+			pending = requestKey(t, st)
+		}
+		_, err := st.Install(test.cert(pending))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: rejected: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%v: installed", test.name)
+		case test.err != "" && !bytes.HasPrefix([]byte(err.Error()), []byte(test.err)):
+			t.Errorf("%v: error %q, want %q", test.name, err, test.err)
+		}
+		if test.err != "" {
+			if cert, _ := st.Certificate(); cert != nil {
+				t.Errorf("%v: rejected certificate installed", test.name)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestInstallRollback(t *testing.T) {
+	st, cleanup := newTestStore(t)
+	defer cleanup()
+	now := time.Now()
+
+	first := issue(t, requestKey(t, st), now.Add(-time.Hour), now.Add(time.Hour))
+	if _, err := st.Install(first); err != nil {
+		t.Fatal(err)
+	}
+	firstKey, err := ioutil.ReadFile(st.path(keyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(st.path(pendingKeyFile)); !os.IsNotExist(err) {
+		t.Errorf("pending key kept after install")
+	}
+	bundle, err := ioutil.ReadFile(st.BundlePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bundle, append(append([]byte{}, first...), firstKey...)) {
+		t.Errorf("bundle is not the certificate followed by its key")
+	}
+
+	second := issue(t, requestKey(t, st), now.Add(-time.Hour), now.Add(time.Hour))
+	if _, err := st.Install(second); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(st.path(certFile)); !bytes.Equal(content, second) {
+		t.Errorf("second certificate not installed")
+	}
+
+	if err := st.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(st.path(certFile)); !bytes.Equal(content, first) {
+		t.Errorf("first certificate not restored")
+	}
+	if content, _ := ioutil.ReadFile(st.path(keyFile)); !bytes.Equal(content, firstKey) {
+		t.Errorf("first key not restored")
+	}
+
+	//nothing left to restore, the store is emptied
+	if err := st.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := st.Certificate(); cert != nil || err != nil {
+		t.Errorf("certificate left after the last rollback: %v %v", cert, err)
+	}
+}
@@ -0,0 +1,179 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	gm "github.com/energieip/common-group-go/pkg/groupmodel"
+)
+
+const (
+	dateLayout = "2006-01-02"
+)
+
+//Entry group settings applied when the cron expression matches
+type Entry struct {
+	ID           string                 `json:"id"`
+	Cron         string                 `json:"cron"` //minute hour day-of-month month day-of-week
+	Groups       map[int]gm.GroupConfig `json:"groups"`
+	SkipHolidays bool                   `json:"skipHolidays"`
+	HolidaysOnly bool                   `json:"holidaysOnly"`
+}
+
+//Schedule group scenarios executed by the switch
+type Schedule struct {
+	Holidays []string `json:"holidays"` //YYYY-MM-DD
+	Entries  []Entry  `json:"entries"`
+}
+
+type cronSpec struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	days     map[int]bool
+	months   map[int]bool
+	weekdays map[int]bool
+	anyDay   bool //day of month or day of week starts with *
+}
+
+//Validate return the reason of every invalid entry, indexed by field
+func (s Schedule) Validate() map[string]string {
+	errs := make(map[string]string)
+	for i, date := range s.Holidays {
+		_, err := time.Parse(dateLayout, date)
+		if err != nil {
+			errs["holidays["+strconv.Itoa(i)+"]"] = "invalid date " + date
+		}
+	}
+	ids := make(map[string]bool)
+	for i, entry := range s.Entries {
+		field := "entries[" + strconv.Itoa(i) + "]"
+		if entry.ID == "" || ids[entry.ID] {
+			errs[field+".id"] = "missing or duplicated id"
+		}
+		ids[entry.ID] = true
+		_, err := parseCron(entry.Cron)
+		if err != nil {
+			errs[field+".cron"] = err.Error()
+		}
+		if entry.SkipHolidays && entry.HolidaysOnly {
+			errs[field] = "skipHolidays and holidaysOnly are exclusive"
+		}
+		if len(entry.Groups) == 0 {
+			errs[field+".groups"] = "no group settings"
+		}
+		for grID, group := range entry.Groups {
+			if grID < 0 || group.Group != grID {
+				errs[field+".groups["+strconv.Itoa(grID)+"]"] = "invalid group identifier"
+			}
+		}
+	}
+	return errs
+}
+
+//Due return the entries to run at the given minute
+func (s Schedule) Due(date time.Time) []Entry {
+	var due []Entry
+	holiday := false
+	day := date.Format(dateLayout)
+	for _, h := range s.Holidays {
+		if h == day {
+			holiday = true
+			break
+		}
+	}
+	for _, entry := range s.Entries {
+		if (entry.SkipHolidays && holiday) || (entry.HolidaysOnly && !holiday) {
+			continue
+		}
+		spec, err := parseCron(entry.Cron)
+		if err != nil {
+			continue
+		}
+		if spec.matches(date) {
+			due = append(due, entry)
+		}
+	}
+	return due
+}
+
+//matches follow the cron rule: when both the day of month and the day of week are restricted,
+//a date matching either of them is due
+func (c cronSpec) matches(date time.Time) bool {
+	day := c.days[date.Day()] && c.weekdays[int(date.Weekday())]
+	if !c.anyDay {
+		day = c.days[date.Day()] || c.weekdays[int(date.Weekday())]
+	}
+	return c.minutes[date.Minute()] && c.hours[date.Hour()] && c.months[int(date.Month())] && day
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression needs 5 fields")
+	}
+	var spec cronSpec
+	var err error
+	if spec.minutes, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hours, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.days, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.months, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.weekdays, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if spec.weekdays[7] {
+		spec.weekdays[0] = true
+	}
+	spec.anyDay = strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*")
+	return &spec, nil
+}
+
+//parseField parse a cron field: *, n, a-b, with an optional /step, separated by commas
+func parseField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, errors.New("invalid step in " + field)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value in " + field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New("invalid range in " + field)
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, errors.New("out of range value in " + field)
+		}
+		for v := start; v <= end; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
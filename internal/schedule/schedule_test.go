@@ -0,0 +1,110 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	date := func(day, hour, minute int) time.Time {
+		//January 2024 starts on a Monday
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		date time.Time
+		want bool
+	}{
+		{"every minute", "* * * * *", date(9, 13, 27), true},
+		{"fixed time", "0 8 * * *", date(9, 8, 0), true},
+		{"fixed time other minute", "0 8 * * *", date(9, 8, 1), false},
+		{"minute step", "*/15 * * * *", date(9, 8, 30), true},
+		{"minute step off", "*/15 * * * *", date(9, 8, 31), false},
+		{"hour range", "0 8-18 * * *", date(9, 18, 0), true},
+		{"hour range off", "0 8-18 * * *", date(9, 19, 0), false},
+		{"hour list", "0 8,12 * * *", date(9, 12, 0), true},
+		{"month", "0 8 * 2 *", date(9, 8, 0), false},
+		//both day fields restricted: either of them
+		{"day of month and week, both", "0 8 1 * 1", date(1, 8, 0), true},
+		{"day of month and week, week", "0 8 1 * 1", date(8, 8, 0), true},
+		{"day of month and week, month", "0 8 9 * 1", date(9, 8, 0), true},
+		{"day of month and week, none", "0 8 1 * 1", date(9, 8, 0), false},
+		//a day field starting with *: both of them
+		{"day of month step and week", "0 8 */2 * 1", date(1, 8, 0), true},
+		{"day of month step, other week day", "0 8 */2 * 1", date(3, 8, 0), false},
+		{"day of month step off, week day", "0 8 */2 * 1", date(8, 8, 0), false},
+		{"week step and day of month", "0 8 15 * */2", date(15, 8, 0), false},
+		{"any day of month", "0 8 * * 2", date(9, 8, 0), true},
+		{"any day of month, other week day", "0 8 * * 2", date(10, 8, 0), false},
+		{"any day of week", "0 8 10 * *", date(10, 8, 0), true},
+		//7 is Sunday as 0
+		{"sunday as 7", "0 8 * * 7", date(7, 8, 0), true},
+		{"sunday as 0", "0 8 * * 0", date(7, 8, 0), true},
+		{"sunday as 7, saturday", "0 8 * * 7", date(6, 8, 0), false},
+		{"week range to sunday", "0 8 * * 5-7", date(7, 8, 0), true},
+	}
+	for _, test := range tests {
+		spec, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: parseCron(%q): %v", test.name, test.expr, err)
+			continue
+		}
+		if got := spec.matches(test.date); got != test.want {
+			t.Errorf("%s: %q matches %v = %v, want %v", test.name, test.expr, test.date, got, test.want)
+		}
+	}
+}
+
+func TestDueHolidays(t *testing.T) {
+	sched := Schedule{
+		Holidays: []string{"2024-01-01"},
+		Entries: []Entry{
+			{ID: "work", Cron: "0 8 * * *", SkipHolidays: true},
+			{ID: "holiday", Cron: "0 8 * * *", HolidaysOnly: true},
+			{ID: "always", Cron: "0 8 * * *"},
+		},
+	}
+	tests := []struct {
+		date time.Time
+		want []string
+	}{
+		{time.Date(2024, time.January, 1, 8, 0, 0, 0, time.UTC), []string{"holiday", "always"}},
+		{time.Date(2024, time.January, 2, 8, 0, 0, 0, time.UTC), []string{"work", "always"}},
+		{time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC), nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, entry := range sched.Due(test.date) {
+			got = append(got, entry.ID)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Due(%v) = %v, want %v", test.date, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("Due(%v) = %v, want %v", test.date, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+)
+
+//Secret reference prefixes accepted in the configuration values
+const (
+	PrefixFile     = "file:"     //root-only file holding the value
+	PrefixEnv      = "env:"      //environment variable
+	PrefixKeystore = "keystore:" //entry of the encrypted keystore
+
+	keySize = 32
+)
+
+//Keystore encrypted local store of secrets
+type Keystore struct {
+	conf    config.SecretsConfig
+	entries map[string]string
+	mutex   sync.Mutex
+}
+
+//OpenKeystore decrypt the keystore, a missing keystore is empty
+func OpenKeystore(conf config.SecretsConfig) (*Keystore, error) {
+	ks := Keystore{
+		conf:    conf,
+		entries: make(map[string]string),
+	}
+	content, err := ioutil.ReadFile(conf.Keystore)
+	if os.IsNotExist(err) {
+		return &ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := ks.cipher(false)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("keystore too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt keystore: " + err.Error())
+	}
+	err = json.Unmarshal(plain, &ks.entries)
+	if err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+//cipher load the keystore key, it is generated when create is set and the key is missing
+func (ks *Keystore) cipher(create bool) (cipher.AEAD, error) {
+	key, err := readSecretFile(ks.conf.KeyFile)
+	if os.IsNotExist(err) && create {
+		raw := make([]byte, keySize)
+		if _, err = io.ReadFull(rand.Reader, raw); err != nil {
+			return nil, err
+		}
+		key = base64.StdEncoding.EncodeToString(raw)
+		err = core.WriteFile(ks.conf.KeyFile, []byte(key+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != keySize {
+		return nil, errors.New("invalid keystore key " + ks.conf.KeyFile)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Get return a keystore entry
+func (ks *Keystore) Get(name string) (string, bool) {
+	if ks == nil {
+		return "", false
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	value, ok := ks.entries[name]
+	return value, ok
+}
+
+//Set store an entry and write the encrypted keystore
+func (ks *Keystore) Set(name, value string) error {
+	return ks.SetAll(map[string]string{name: value})
+}
+
+//SetAll store several entries in a single write of the encrypted keystore
+func (ks *Keystore) SetAll(values map[string]string) error {
+	return ks.update(func(entries map[string]string) {
+		for name, value := range values {
+			entries[name] = value
+		}
+	})
+}
+
+//Delete remove entries and write the encrypted keystore
+func (ks *Keystore) Delete(names ...string) error {
+	return ks.update(func(entries map[string]string) {
+		for _, name := range names {
+			delete(entries, name)
+		}
+	})
+}
+
+//update write the changed entries, the keystore is unchanged when the write fails
+func (ks *Keystore) update(change func(map[string]string)) error {
+	if ks == nil {
+		return errors.New("keystore not available")
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	entries := make(map[string]string)
+	for name, value := range ks.entries {
+		entries[name] = value
+	}
+	change(entries)
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	gcm, err := ks.cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := gcm.Seal(nonce, nonce, plain, nil)
+	err = core.WriteFile(ks.conf.Keystore, []byte(base64.StdEncoding.EncodeToString(sealed)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	ks.entries = entries
+	return nil
+}
+
+//Resolve return the value of a secret reference, other values are returned as is
+func Resolve(value string, ks *Keystore) (string, error) {
+	switch {
+	case strings.HasPrefix(value, PrefixFile):
+		return readSecretFile(strings.TrimPrefix(value, PrefixFile))
+	case strings.HasPrefix(value, PrefixEnv):
+		name := strings.TrimPrefix(value, PrefixEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " not set")
+		}
+		return secret, nil
+	case strings.HasPrefix(value, PrefixKeystore):
+		name := strings.TrimPrefix(value, PrefixKeystore)
+		secret, ok := ks.Get(name)
+		if !ok {
+			return "", errors.New("keystore entry " + name + " not found")
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+//readSecretFile read a secret file owned by root and not readable by other users
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", errors.New(path + " is accessible to other users")
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		return "", errors.New(path + " is not owned by root")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
@@ -0,0 +1,162 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+)
+
+func newTestConfig(t *testing.T) (config.SecretsConfig, func()) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.SecretsConfig{
+		Keystore: filepath.Join(dir, "keystore"),
+		KeyFile:  filepath.Join(dir, "keystore.key"),
+	}
+	return conf, func() { os.RemoveAll(dir) }
+}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the keystore key must be owned by root")
+	}
+	conf, cleanup := newTestConfig(t)
+	defer cleanup()
+
+	ks, err := OpenKeystore(conf)
+	if err != nil {
+		t.Fatalf("missing keystore: %v", err)
+	}
+	err = ks.SetAll(map[string]string{"login": "switch", "password": "s3cr3t\nwith newline"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Set("token", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Delete("token"); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(conf.Keystore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"switch", "s3cr3t"} {
+		if base64Contains(content, value) {
+			t.Errorf("keystore holds %q in clear", value)
+		}
+	}
+	info, err := os.Stat(conf.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v", info.Mode().Perm())
+	}
+
+	reopened, err := OpenKeystore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		value string
+		found bool
+	}{
+		{"login", "switch", true},
+		{"password", "s3cr3t\nwith newline", true},
+		{"token", "", false},
+		{"unknown", "", false},
+	}
+	for _, test := range tests {
+		value, ok := reopened.Get(test.name)
+		if ok != test.found || value != test.value {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v", test.name, value, ok, test.value, test.found)
+		}
+	}
+	value, err := Resolve(PrefixKeystore+"login", reopened)
+	if err != nil || value != "switch" {
+		t.Errorf("Resolve keystore entry = %q, %v", value, err)
+	}
+	if _, err = Resolve(PrefixKeystore+"token", reopened); err == nil {
+		t.Errorf("deleted entry resolved")
+	}
+}
+
+func TestKeystoreRejected(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the keystore key must be owned by root")
+	}
+	conf, cleanup := newTestConfig(t)
+	defer cleanup()
+	ks, err := OpenKeystore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Set("password", "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadFile(conf.Keystore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		prepare func() error
+	}{
+		{"other key", func() error {
+			key := base64.StdEncoding.EncodeToString(make([]byte, keySize))
+			return ioutil.WriteFile(conf.KeyFile, []byte(key+"\n"), 0600)
+		}},
+		{"key readable by others", func() error {
+			return os.Chmod(conf.KeyFile, 0644)
+		}},
+		{"short key", func() error {
+			return ioutil.WriteFile(conf.KeyFile, []byte("c2hvcnQ=\n"), 0600)
+		}},
+		{"tampered keystore", func() error {
+			raw, err := base64.StdEncoding.DecodeString(string(sealed[:len(sealed)-1]))
+			if err != nil {
+				return err
+			}
+			raw[len(raw)-1] ^= 1
+			return ioutil.WriteFile(conf.Keystore, []byte(base64.StdEncoding.EncodeToString(raw)), 0600)
+		}},
+	}
+	key, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if err = ioutil.WriteFile(conf.KeyFile, key, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(conf.Keystore, sealed, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = test.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = OpenKeystore(conf); err == nil {
+			t.Errorf("%v: keystore opened", test.name)
+		}
+	}
+}
+
+//base64Contains check if the encoded keystore content holds the value in clear
+func base64Contains(content []byte, value string) bool {
+	raw, err := base64.StdEncoding.DecodeString(string(content[:len(content)-1]))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(raw), value)
+}
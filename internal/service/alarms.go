@@ -0,0 +1,84 @@
+package service
+
+import (
+	"time"
+
+	sd "github.com/energieip/common-switch-go/pkg/deviceswitch"
+	"github.com/energieip/swh200-coreservice-go/internal/alarm"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlAlarm = "alarm/event"
+)
+
+//loadAlarmRules restore the rules received from the server before the restart
+func (s *CoreService) loadAlarmRules() {
+	s.alarms = alarm.NewEngine()
+	rules, err := alarm.LoadRules(s.conf.Alarm.RulesFile)
+	if err != nil {
+		rlog.Error("Cannot load alarm rules " + err.Error())
+		return
+	}
+	s.alarms.SetRules(rules)
+	rlog.Infof("%v alarm rules loaded", len(rules))
+}
+
+func (s *CoreService) setAlarmRules(rules []alarm.Rule) {
+	s.sendAlarms(s.alarms.SetRules(rules))
+	err := alarm.SaveRules(s.conf.Alarm.RulesFile, rules)
+	if err != nil {
+		rlog.Error("Cannot save alarm rules " + err.Error())
+	}
+	rlog.Infof("%v alarm rules applied", len(rules))
+}
+
+//evaluateAlarms apply the alarm rules on the devices of the status dump
+func (s *CoreService) evaluateAlarms(status sd.SwitchStatus) {
+	leds := make(map[string]map[string]interface{})
+	for mac, led := range status.Leds {
+		leds[mac] = deviceAttributes(led)
+	}
+	sensors := make(map[string]map[string]interface{})
+	for mac, sensor := range status.Sensors {
+		sensors[mac] = deviceAttributes(sensor)
+	}
+	s.sendAlarms(s.alarms.Evaluate(DevicesLed, leds))
+	s.sendAlarms(s.alarms.Evaluate(DevicesSensor, sensors))
+	if s.conf.Alarm.ForgetAfter > 0 {
+		s.sendAlarms(s.alarms.Expire(time.Duration(s.conf.Alarm.ForgetAfter) * time.Second))
+	}
+}
+
+//forgetAlarmDevices stop the alarms of the devices removed from the switch
+func (s *CoreService) forgetAlarmDevices(switchConfig sd.SwitchConfig) {
+	for mac := range switchConfig.LedsSetup {
+		s.sendAlarms(s.alarms.Forget(DevicesLed, mac))
+	}
+	for mac := range switchConfig.LedsConfig {
+		s.sendAlarms(s.alarms.Forget(DevicesLed, mac))
+	}
+	for mac := range switchConfig.SensorsSetup {
+		s.sendAlarms(s.alarms.Forget(DevicesSensor, mac))
+	}
+	for mac := range switchConfig.SensorsConfig {
+		s.sendAlarms(s.alarms.Forget(DevicesSensor, mac))
+	}
+}
+
+func (s *CoreService) sendAlarms(events []alarm.Event) {
+	for _, event := range events {
+		event.SwitchMac = s.mac
+		dump, err := event.ToJSON()
+		if err != nil {
+			rlog.Error("Could not dump alarm " + err.Error())
+			continue
+		}
+		err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlAlarm, dump)
+		if err != nil {
+			rlog.Errorf("Could not send alarm %v to the server %v", event.RuleID, err.Error())
+			continue
+		}
+		rlog.Warnf("Alarm %v %v on %v %v", event.RuleID, event.State, event.Device, event.Mac)
+	}
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/energieip/swh200-coreservice-go/internal/pki"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionCertificateTrial = "CertificateTrial"
+
+	CertificateInitial = "initial"
+	CertificateRenewal = "renewal"
+)
+
+//CertificateRequest certificate signing request sent to the server in the hello
+type CertificateRequest struct {
+	Mac    string `json:"mac"`
+	Reason string `json:"reason"` //initial or renewal
+	Csr    string `json:"csr"`    //PEM
+}
+
+//ToJSON dump certificate request struct
+func (r CertificateRequest) ToJSON() (string, error) {
+	inrec, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+func (s *CoreService) initCertificates() {
+	if !s.conf.Certificates.Enabled {
+		return
+	}
+	s.pki = pki.NewStore(s.conf.Certificates.Dir)
+	s.brokerKeyPath = s.serviceConf.NetworkBroker.KeyPath
+	s.useClientCertificate(&s.serviceConf)
+}
+
+//useClientCertificate connect the server broker with the provisioned certificate once installed
+func (s *CoreService) useClientCertificate(conf *pkg.ServiceConfig) {
+	if s.pki == nil {
+		return
+	}
+	cert, err := s.pki.Certificate()
+	if err != nil {
+		rlog.Error("Cannot read client certificate " + err.Error())
+		return
+	}
+	if cert != nil {
+		conf.NetworkBroker.KeyPath = s.pki.BundlePath()
+	}
+}
+
+//needsCertificateRequest true when the certificate is missing or close to its expiry and no request
+//was sent recently
+func (s *CoreService) needsCertificateRequest() bool {
+	renewBefore := time.Duration(s.conf.Certificates.RenewBefore) * 24 * time.Hour
+	if s.pki == nil || s.certificateTrial || !s.pki.NeedsCertificate(renewBefore) {
+		return false
+	}
+	return time.Since(s.lastCertificateRequest) >= CertificateCheckPeriod
+}
+
+//certificateRequest signing request carried by the hello, nil when none is needed
+func (s *CoreService) certificateRequest() *CertificateRequest {
+	if !s.needsCertificateRequest() {
+		return nil
+	}
+	reason := CertificateRenewal
+	if cert, _ := s.pki.Certificate(); cert == nil {
+		reason = CertificateInitial
+	}
+	csr, err := s.pki.CreateRequest(s.mac)
+	if err != nil {
+		rlog.Error("Cannot create certificate request " + err.Error())
+		return nil
+	}
+	return &CertificateRequest{
+		Mac:    s.mac,
+		Reason: reason,
+		Csr:    string(csr),
+	}
+}
+
+//requestCertificate send a hello carrying a signing request when the certificate is missing or close
+//to its expiry
+func (s *CoreService) requestCertificate() {
+	if s.needsCertificateRequest() {
+		s.sendHello()
+	}
+}
+
+//installCertificate install the certificate and reconnect, the previous one is restored when the
+//server cannot be reached with it
+func (s *CoreService) installCertificate(delivery network.CertificateDelivery) {
+	entry := audit.Entry{
+		Category: audit.CategoryCertificate,
+		Action:   "install",
+	}
+	if s.pki == nil {
+		entry.Error = "certificate provisioning disabled"
+		s.audit.Record(entry)
+		rlog.Warn("Certificate received while provisioning is disabled")
+		return
+	}
+	if s.certificateTrial {
+		//the previous certificate is the last known-good one until the trial ends
+		entry.Error = "certificate trial in progress"
+		s.audit.Record(entry)
+		rlog.Warn("Certificate received while the previous one is still being tried, ignore it")
+		return
+	}
+	cert, err := s.pki.Install([]byte(delivery.Certificate))
+	if err != nil {
+		entry.Error = err.Error()
+		s.audit.Record(entry)
+		rlog.Error("Cannot install certificate " + err.Error())
+		return
+	}
+	entry.Target = cert.Subject.String()
+	entry.Details = "expires " + cert.NotAfter.UTC().Format(time.RFC3339)
+	s.audit.Record(entry)
+	rlog.Info("Certificate " + entry.Target + " installed, reconnect the server broker")
+
+	s.certificateTrial = true
+	s.useClientCertificate(&s.serviceConf)
+	s.reconnectServer()
+	time.AfterFunc(time.Duration(s.conf.Certificates.RollbackTimeout)*time.Second, func() {
+		s.trigger(ActionCertificateTrial)
+	})
+}
+
+//checkCertificateTrial roll back the certificate when the server was not reached in time
+func (s *CoreService) checkCertificateTrial() {
+	if !s.certificateTrial {
+		return
+	}
+	s.certificateTrial = false
+	if s.serverState == network.BrokerConnected {
+		return
+	}
+	entry := audit.Entry{
+		Category: audit.CategoryCertificate,
+		Action:   "rollback",
+	}
+	err := s.pki.Rollback()
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit.Record(entry)
+	rlog.Warn("Server not reached with the new certificate, restore the previous one")
+	s.serviceConf.NetworkBroker.KeyPath = s.brokerKeyPath
+	s.useClientCertificate(&s.serviceConf)
+	s.reconnectServer()
+}
+
+//certificateValidated keep the new certificate once the server is reached
+func (s *CoreService) certificateValidated() {
+	if s.certificateTrial {
+		s.certificateTrial = false
+		rlog.Info("Server reached with the new certificate")
+	}
+	s.requestCertificate()
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"time"
+
+	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/energieip/swh200-coreservice-go/internal/secrets"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionCredentialsTrial = "CredentialsTrial"
+)
+
+//keystore entries of the credentials rotated by the server, they take precedence over the
+//configuration file
+func rotatedLogin(broker string) string {
+	return broker + ".login"
+}
+
+func rotatedPassword(broker string) string {
+	return broker + ".password"
+}
+
+func (s *CoreService) openKeystore() {
+	keystore, err := secrets.OpenKeystore(s.conf.Secrets)
+	if err != nil {
+		//only the keystore references fail
+		rlog.Error("Cannot open keystore " + s.conf.Secrets.Keystore + " error: " + err.Error())
+		return
+	}
+	s.keystore = keystore
+}
+
+//resolveCredentials replace the secret references of the brokers login and password
+func (s *CoreService) resolveCredentials(conf *pkg.ServiceConfig) error {
+	brokers := map[string]*pkg.BrokerConnection{
+		network.BrokerServer: &conf.NetworkBroker,
+		network.BrokerLocal:  &conf.LocalBroker,
+	}
+	for name, broker := range brokers {
+		login, err := secrets.Resolve(broker.Login, s.keystore)
+		if err != nil {
+			return err
+		}
+		password, err := secrets.Resolve(broker.Password, s.keystore)
+		if err != nil {
+			return err
+		}
+		if rotated, ok := s.keystore.Get(rotatedLogin(name)); ok {
+			login = rotated
+		}
+		if rotated, ok := s.keystore.Get(rotatedPassword(name)); ok {
+			password = rotated
+		}
+		broker.Login = login
+		broker.Password = password
+	}
+	return nil
+}
+
+//credentialsTrial rotated credentials not validated by a broker connection yet
+type credentialsTrial struct {
+	network.CredentialsRotation
+	previous pkg.BrokerConnection
+	deadline time.Time
+}
+
+//brokerConnection settings of the server or drivers broker
+func brokerConnection(conf *pkg.ServiceConfig, broker string) *pkg.BrokerConnection {
+	if broker == network.BrokerLocal {
+		return &conf.LocalBroker
+	}
+	return &conf.NetworkBroker
+}
+
+//applyCredentialsTrial keep trying the rotated credentials in a reloaded configuration, its own
+//credentials are restored when the trial fails
+func (s *CoreService) applyCredentialsTrial(conf *pkg.ServiceConfig) {
+	trial := s.credentialsTrial
+	if trial == nil {
+		return
+	}
+	broker := brokerConnection(conf, trial.Broker)
+	trial.previous = *broker
+	if trial.Login != "" {
+		broker.Login = trial.Login
+	}
+	broker.Password = trial.Password
+}
+
+func (s *CoreService) reconnectBroker(broker string) {
+	if broker == network.BrokerLocal {
+		s.reconnectLocal()
+		return
+	}
+	s.reconnectServer()
+}
+
+//rotateCredentials reconnect the broker with the new credentials, they are stored once the broker
+//is reached and the previous ones are restored otherwise
+func (s *CoreService) rotateCredentials(cmd network.CredentialsRotation) {
+	entry := audit.Entry{
+		Category: audit.CategoryCredentials,
+		Action:   "rotate",
+		Target:   cmd.Broker,
+	}
+	if cmd.Login != "" {
+		entry.Details = "login " + cmd.Login
+	}
+	if s.credentialsTrial != nil {
+		entry.Error = "credentials trial in progress on the " + s.credentialsTrial.Broker + " broker"
+		s.audit.Record(entry)
+		rlog.Warn("Credentials received while the previous ones are still being tried, ignore them")
+		return
+	}
+	s.audit.Record(entry)
+
+	broker := brokerConnection(&s.serviceConf, cmd.Broker)
+	timeout := time.Duration(s.conf.Secrets.RotationTimeout) * time.Second
+	s.credentialsTrial = &credentialsTrial{
+		CredentialsRotation: cmd,
+		previous:            *broker,
+		deadline:            time.Now().Add(timeout),
+	}
+	if cmd.Login != "" {
+		broker.Login = cmd.Login
+	}
+	broker.Password = cmd.Password
+	rlog.Info("Try the rotated credentials of the " + cmd.Broker + " broker")
+	time.AfterFunc(timeout, func() {
+		s.trigger(ActionCredentialsTrial)
+	})
+	s.reconnectBroker(cmd.Broker)
+}
+
+//credentialsValidated store the rotated credentials once their broker is reached
+func (s *CoreService) credentialsValidated(broker string) {
+	trial := s.credentialsTrial
+	if trial == nil || trial.Broker != broker {
+		return
+	}
+	s.credentialsTrial = nil
+	entry := audit.Entry{
+		Category: audit.CategoryCredentials,
+		Action:   "commit",
+		Target:   broker,
+	}
+	rotated := map[string]string{rotatedPassword(broker): trial.Password}
+	if trial.Login != "" {
+		rotated[rotatedLogin(broker)] = trial.Login
+	}
+	err := s.keystore.SetAll(rotated)
+	if err != nil {
+		//they work until the next restart
+		entry.Error = err.Error()
+		s.audit.Record(entry)
+		rlog.Error("Cannot store " + broker + " broker credentials " + err.Error())
+		return
+	}
+	s.audit.Record(entry)
+	rlog.Info("Credentials of the " + broker + " broker rotated")
+}
+
+//checkCredentialsTrial restore the previous credentials when the broker was not reached in time
+func (s *CoreService) checkCredentialsTrial() {
+	trial := s.credentialsTrial
+	if trial == nil || time.Now().Before(trial.deadline) {
+		return
+	}
+	s.credentialsTrial = nil
+	entry := audit.Entry{
+		Category: audit.CategoryCredentials,
+		Action:   "rollback",
+		Target:   trial.Broker,
+	}
+	s.audit.Record(entry)
+	rlog.Warn("The " + trial.Broker + " broker was not reached with the rotated credentials, restore the previous ones")
+	broker := brokerConnection(&s.serviceConf, trial.Broker)
+	broker.Login = trial.previous.Login
+	broker.Password = trial.previous.Password
+	s.reconnectBroker(trial.Broker)
+}
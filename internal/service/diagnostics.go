@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/energieip/swh200-coreservice-go/internal/diagnostics"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlDiagnostics = "diagnostics/chunk"
+
+	diagnosticsAuditEntries = 500
+)
+
+//collectDiagnostics gather the service data then build and upload the archive in background
+func (s *CoreService) collectDiagnostics(req network.DiagnosticsRequest) {
+	if !atomic.CompareAndSwapInt32(&s.diagnosing, 0, 1) {
+		s.sendDiagnosticsChunk(diagnostics.Chunk{Mac: s.mac, ID: req.ID, Error: "diagnostics already running"})
+		return
+	}
+
+	files := make(map[string][]byte)
+	if s.lastDump != "" {
+		files["status.json"] = []byte(s.lastDump)
+	}
+	var coreLog []byte
+	for _, line := range s.logs.Tail(s.conf.Logs.BufferLines, "") {
+		message := diagnostics.RedactLog(line.Message)
+		coreLog = append(coreLog, []byte(line.Date+" "+line.Level+" "+message+"\n")...)
+	}
+	files["core.log"] = coreLog
+	entries, err := audit.Read(s.conf.Audit, audit.Query{Limit: diagnosticsAuditEntries})
+	if err == nil {
+		files["audit.json"], _ = json.MarshalIndent(entries, "", "  ")
+	}
+	units := []string{core.CorePackage}
+	for _, service := range s.services {
+		units = append(units, service.PackageName)
+	}
+	src := diagnostics.Sources{
+		ConfigFile: s.confFile,
+		Units:      units,
+		Files:      files,
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&s.diagnosing, 0)
+		entry := audit.Entry{
+			Category: audit.CategoryService,
+			Action:   "diagnostics",
+			Target:   req.ID,
+		}
+		archive, err := diagnostics.Collect(src)
+		if err != nil {
+			rlog.Error("Cannot build diagnostics archive " + err.Error())
+			entry.Error = err.Error()
+			s.audit.Record(entry)
+			s.sendDiagnosticsChunk(diagnostics.Chunk{Mac: s.mac, ID: req.ID, Error: err.Error()})
+			return
+		}
+		chunks := diagnostics.Split(archive, s.mac, req.ID, req.ChunkSize)
+		for _, chunk := range chunks {
+			if !s.sendDiagnosticsChunk(chunk) {
+				entry.Error = "upload interrupted"
+				break
+			}
+		}
+		s.audit.Record(entry)
+		rlog.Infof("Diagnostics %v sent to the server in %v chunks", req.ID, len(chunks))
+	}()
+}
+
+func (s *CoreService) sendDiagnosticsChunk(chunk diagnostics.Chunk) bool {
+	dump, err := chunk.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump diagnostics chunk " + err.Error())
+		return false
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlDiagnostics, dump)
+	if err != nil {
+		rlog.Errorf("Could not send diagnostics chunk %v to the server %v", chunk.Index, err.Error())
+		return false
+	}
+	return true
+}
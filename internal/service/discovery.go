@@ -0,0 +1,115 @@
+package service
+
+import (
+	"encoding/json"
+
+	dl "github.com/energieip/common-led-go/pkg/driverled"
+	ds "github.com/energieip/common-sensor-go/pkg/driversensor"
+	"github.com/energieip/swh200-coreservice-go/internal/database"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlDiscovery = "setup/discovery"
+)
+
+//DeviceDiscovery event sent to the server for a device waiting for its configuration
+type DeviceDiscovery struct {
+	SwitchMac    string                 `json:"switchMac"`
+	Type         string                 `json:"type"` //led or sensor
+	Mac          string                 `json:"mac"`
+	Capabilities map[string]interface{} `json:"capabilities"` //attributes reported by the driver
+}
+
+//ToJSON dump device discovery struct
+func (d DeviceDiscovery) ToJSON() (string, error) {
+	inrec, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//deviceAttributes return the device status fields as a generic map
+func deviceAttributes(device interface{}) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	inrec, err := json.Marshal(device)
+	if err != nil {
+		return attributes
+	}
+	json.Unmarshal(inrec, &attributes)
+	return attributes
+}
+
+func isConfigured(attributes map[string]interface{}) bool {
+	for _, key := range []string{"isConfigured", "IsConfigured"} {
+		if value, ok := attributes[key].(bool); ok {
+			return value
+		}
+	}
+	return false
+}
+
+//checkDiscoveries report the unconfigured devices of the switch not reported yet, the devices
+//are the ones read for the status dump
+func (s *CoreService) checkDiscoveries(leds map[string]dl.Led, sensors map[string]ds.Sensor) {
+	pending := make(map[string]bool)
+	for mac, led := range leds {
+		s.reportDiscovery(DevicesLed, mac, deviceAttributes(led), pending)
+	}
+	for mac, sensor := range sensors {
+		s.reportDiscovery(DevicesSensor, mac, deviceAttributes(sensor), pending)
+	}
+	s.discovered = pending
+}
+
+//checkDiscovery report a device announced by its driver when it is not configured
+func (s *CoreService) checkDiscovery(driver, mac string) {
+	var device interface{}
+	switch driver {
+	case DevicesLed:
+		if led := database.GetLed(s.db, mac); led != nil {
+			device = *led
+		}
+	case DevicesSensor:
+		if sensor := database.GetSensor(s.db, mac); sensor != nil {
+			device = *sensor
+		}
+	}
+	if device == nil {
+		return
+	}
+	s.reportDiscovery(driver, mac, deviceAttributes(device), s.discovered)
+}
+
+func (s *CoreService) reportDiscovery(deviceType, mac string, attributes map[string]interface{}, pending map[string]bool) {
+	if isConfigured(attributes) {
+		return
+	}
+	reported := s.discovered[mac]
+	pending[mac] = true
+	if reported {
+		return
+	}
+	for _, key := range []string{"isConfigured", "IsConfigured", "switchMac", "SwitchMac", "mac", "Mac"} {
+		delete(attributes, key)
+	}
+	discovery := DeviceDiscovery{
+		SwitchMac:    s.mac,
+		Type:         deviceType,
+		Mac:          mac,
+		Capabilities: attributes,
+	}
+	dump, err := discovery.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump device discovery " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlDiscovery, dump)
+	if err != nil {
+		rlog.Errorf("Could not send discovery of %v to the server %v", mac, err.Error())
+		delete(pending, mac)
+		return
+	}
+	rlog.Info("Discovery of unconfigured " + deviceType + " " + mac + " sent to the server")
+}
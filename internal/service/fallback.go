@@ -0,0 +1,170 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	gm "github.com/energieip/common-group-go/pkg/groupmodel"
+	sd "github.com/energieip/common-switch-go/pkg/deviceswitch"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionFallback = "Fallback"
+
+	UrlGroupSettings = "/write/switch/group/update/settings"
+)
+
+//loadFallbackScenario restore the scenario and the server group settings received before the restart
+func (s *CoreService) loadFallbackScenario() {
+	s.fallbackGroups = make(map[int]gm.GroupConfig)
+	err := core.LoadJSON(s.conf.Fallback.ScenarioFile, &s.fallbackGroups)
+	if err != nil {
+		rlog.Error("Cannot load fallback scenario " + err.Error())
+	}
+	groups := make(map[int]gm.GroupConfig)
+	err = core.LoadJSON(s.conf.Fallback.GroupsFile, &groups)
+	if err != nil {
+		rlog.Error("Cannot load server group settings " + err.Error())
+	}
+	//restored to the drivers after a broker loss and when leaving the fallback
+	s.cacheConfiguration(sd.SwitchConfig{Groups: groups})
+}
+
+//saveServerGroups persist the group settings received from the server
+func (s *CoreService) saveServerGroups() {
+	groups := s.lastConfig.Groups
+	if groups == nil {
+		groups = make(map[int]gm.GroupConfig)
+	}
+	err := core.SaveJSON(s.conf.Fallback.GroupsFile, groups)
+	if err != nil {
+		rlog.Error("Cannot save server group settings " + err.Error())
+	}
+}
+
+func (s *CoreService) setFallbackScenario(groups map[int]gm.GroupConfig) {
+	s.fallbackGroups = groups
+	err := core.SaveJSON(s.conf.Fallback.ScenarioFile, groups)
+	if err != nil {
+		rlog.Error("Cannot save fallback scenario " + err.Error())
+	}
+	rlog.Infof("Fallback scenario updated for %v groups", len(groups))
+}
+
+func (s *CoreService) onServerState(state string) {
+	s.serverState = state
+	rlog.Info("Server broker " + state)
+	switch state {
+	case network.BrokerDisconnected:
+		s.serverLostAt = time.Now()
+		s.scheduleFallback()
+	case network.BrokerConnected:
+		s.checkFallback()
+		s.sendHello()
+		s.certificateValidated()
+		s.credentialsValidated(network.BrokerServer)
+		s.confirmUpdate()
+	}
+}
+
+//scheduleFallback check the server state once the fallback timeout is reached
+func (s *CoreService) scheduleFallback() {
+	if s.conf.Fallback.Timeout <= 0 {
+		return
+	}
+	time.AfterFunc(time.Duration(s.conf.Fallback.Timeout)*time.Second, func() {
+		s.trigger(ActionFallback)
+	})
+}
+
+//cronFallback check the server messages periodically when the server liveness is watched
+func (s *CoreService) cronFallback() {
+	if s.conf.Fallback.ServerTopic == "" || s.conf.Fallback.ServerTimeout <= 0 || s.conf.Fallback.Timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(network.ProbePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.trigger(ActionFallback)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//serverLostSince return when the server became unreachable, zero when it is reachable
+func (s *CoreService) serverLostSince() time.Time {
+	if s.serverState != network.BrokerConnected {
+		return s.serverLostAt
+	}
+	if s.conf.Fallback.ServerTopic == "" || s.conf.Fallback.ServerTimeout <= 0 {
+		return time.Time{}
+	}
+	//the broker is up but the server may be down
+	seen := s.server.ServerSeen()
+	if time.Since(seen) < time.Duration(s.conf.Fallback.ServerTimeout)*time.Second {
+		return time.Time{}
+	}
+	return seen
+}
+
+func (s *CoreService) checkFallback() {
+	lostAt := s.serverLostSince()
+	if lostAt.IsZero() {
+		if s.fallbackActive {
+			s.leaveFallback()
+		}
+		return
+	}
+	if s.fallbackActive || s.conf.Fallback.Timeout <= 0 {
+		return
+	}
+	timeout := time.Duration(s.conf.Fallback.Timeout) * time.Second
+	if time.Since(lostAt) < timeout {
+		return
+	}
+	s.enterFallback(lostAt)
+}
+
+func (s *CoreService) enterFallback(lostAt time.Time) {
+	s.fallbackActive = true
+	rlog.Warnf("Server unreachable since %v, apply fallback scenario", lostAt.Format(time.RFC3339))
+	s.audit.Record(audit.Entry{
+		Category: audit.CategoryCommand,
+		Action:   "fallback enter",
+		Details:  lostAt.Format(time.RFC3339),
+	})
+	s.sendGroupSettings(s.fallbackGroups)
+}
+
+func (s *CoreService) leaveFallback() {
+	s.fallbackActive = false
+	if len(s.lastConfig.Groups) == 0 {
+		rlog.Warn("Server is back, no server group settings known, keep the fallback ones")
+	} else {
+		rlog.Info("Server is back, restore groups settings")
+	}
+	s.audit.Record(audit.Entry{
+		Category: audit.CategoryCommand,
+		Action:   "fallback leave",
+	})
+	s.sendGroupSettings(s.lastConfig.Groups)
+}
+
+func (s *CoreService) sendGroupSettings(groups map[int]gm.GroupConfig) {
+	if len(groups) == 0 {
+		return
+	}
+	inrec, err := json.Marshal(groups)
+	if err != nil {
+		rlog.Error("Could not dump groups settings " + err.Error())
+		return
+	}
+	s.sendDriverCommand(UrlGroupSettings, string(inrec[:]))
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/energieip/common-tools-go/pkg/tools"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionIdentity = "CheckIdentity"
+)
+
+//detectIdentity return the mac and IP of the configured interface, the historical detection is kept
+//when none is configured so that the switch identifier does not change on upgrade
+func (s *CoreService) detectIdentity() (string, string, error) {
+	if s.conf.Identity.Interface != "" {
+		return core.GetIdentity(s.conf.Identity.Interface)
+	}
+	mac, ip := tools.GetNetworkInfo()
+	if _, err := core.SwitchID(mac); err == nil {
+		return mac, ip, nil
+	}
+	return core.GetIdentity("")
+}
+
+//initIdentity set the switch identifier and IP address
+func (s *CoreService) initIdentity() error {
+	mac, ip, err := s.detectIdentity()
+	if err != nil && s.conf.Identity.SwitchID == "" {
+		return errors.New("cannot detect the switch identity: " + err.Error())
+	}
+	if err != nil {
+		rlog.Warn("Cannot detect network interface " + err.Error())
+	}
+
+	if s.conf.Identity.SwitchID != "" {
+		if !core.ValidSwitchID(s.conf.Identity.SwitchID) {
+			return errors.New("invalid switch identifier " + s.conf.Identity.SwitchID)
+		}
+		s.mac = strings.ToUpper(s.conf.Identity.SwitchID)
+	} else {
+		s.mac, err = core.SwitchID(mac)
+		if err != nil {
+			return err
+		}
+	}
+	s.ip = ip
+	if ip == "" {
+		rlog.Warn("No IPv4 address yet, it will be reported once assigned")
+	}
+	rlog.Info("Switch identifier " + s.mac + " mac " + mac + " IP " + ip)
+	return nil
+}
+
+//cronIdentity check the IP address periodically
+func (s *CoreService) cronIdentity() {
+	if s.conf.Identity.CheckPeriod <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.conf.Identity.CheckPeriod) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.trigger(ActionIdentity)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//checkIdentity announce the new IP address after a DHCP renewal or an interface change
+func (s *CoreService) checkIdentity() {
+	_, ip, err := s.detectIdentity()
+	if err != nil {
+		rlog.Error("Cannot detect network interface " + err.Error())
+		return
+	}
+	if ip == s.ip {
+		return
+	}
+	if ip == "" {
+		//keep announcing the last address until a new one is assigned
+		rlog.Debug("Switch IP " + s.ip + " lost")
+		return
+	}
+	rlog.Info("Switch IP changed from " + s.ip + " to " + ip)
+	s.ip = ip
+	s.server.Presence.SetIP(ip)
+	s.sendHello()
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/logs"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlLogResult = "log/result"
+	UrlLogStream = "log/stream"
+)
+
+//LogResult response to a log command
+type LogResult struct {
+	Mac     string      `json:"mac"`
+	ID      string      `json:"id"`
+	Action  string      `json:"action"`
+	Success bool        `json:"success"`
+	Error   string      `json:"error,omitempty"`
+	Lines   []logs.Line `json:"lines,omitempty"`
+}
+
+//ToJSON dump log result struct
+func (r LogResult) ToJSON() (string, error) {
+	inrec, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//setLogLevel apply the rlog level, the buffer is plugged again as rlog may reset its output
+func (s *CoreService) setLogLevel(level string) {
+	os.Setenv("RLOG_LOG_LEVEL", level)
+	rlog.UpdateEnv()
+	if s.logs != nil {
+		rlog.SetOutput(s.logs)
+	}
+}
+
+func (s *CoreService) runLogCommand(cmd network.LogCommand) {
+	result := LogResult{
+		Mac:     s.mac,
+		ID:      cmd.ID,
+		Action:  cmd.Action,
+		Success: true,
+	}
+	level := cmd.Level
+	switch cmd.Action {
+	case network.LogLevel:
+		s.setLogLevel(level)
+		rlog.Info("Log level set to " + level + " by the server")
+
+	case network.LogStream:
+		if level == "" {
+			level = logs.LevelInfo
+		}
+		s.logs.Stream(level, time.Now().Add(time.Duration(cmd.Duration)*time.Second))
+		rlog.Infof("Stream %v logs to the server for %vs", level, cmd.Duration)
+
+	case network.LogStreamStop:
+		s.logs.StopStream()
+
+	case network.LogTail:
+		lines := cmd.Lines
+		if lines == 0 {
+			lines = DefaultLogLines
+		}
+		result.Lines = s.logs.Tail(lines, level)
+	}
+
+	dump, err := result.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump log result " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlLogResult, dump)
+	if err != nil {
+		rlog.Errorf("Could not send log result to the server %v", err.Error())
+	}
+}
+
+//sendLogLine forward a streamed line, failures are not logged to avoid feeding the stream
+func (s *CoreService) sendLogLine(line logs.Line) {
+	dump, err := line.ToJSON()
+	if err != nil {
+		return
+	}
+	s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlLogStream, dump)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	sd "github.com/energieip/common-switch-go/pkg/deviceswitch"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlCertificate = "security/certificate"
+
+	CertificateCheckPeriod = time.Hour
+	//CertificateWarningPeriod delay before warning again about the same certificate
+	CertificateWarningPeriod = 24 * time.Hour
+)
+
+//switchHello hello completed with the TLS settings of the server connection
+type switchHello struct {
+	sd.Switch
+	TLS network.TLSStatus   `json:"tls"`
+	Csr *CertificateRequest `json:"csr,omitempty"` //client certificate signing request
+}
+
+//ToJSON dump switch hello struct
+func (hello switchHello) ToJSON() (string, error) {
+	inrec, err := json.Marshal(hello)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//CertificateWarning certificate close to its expiry
+type CertificateWarning struct {
+	network.CertificateInfo
+	Mac    string `json:"mac"`
+	Broker string `json:"broker"` //server or local
+}
+
+//ToJSON dump certificate warning struct
+func (w CertificateWarning) ToJSON() (string, error) {
+	inrec, err := json.Marshal(w)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//protocol advertised to the server
+func (s *CoreService) protocol() string {
+	if s.conf.Protocol.Advertised != "" {
+		return s.conf.Protocol.Advertised
+	}
+	return s.server.Protocol()
+}
+
+//checkCertificates warn the server about the broker certificates close to their expiry
+func (s *CoreService) checkCertificates() {
+	if s.conf.Protocol.CertificateWarning <= 0 || time.Since(s.lastCertificateCheck) < CertificateCheckPeriod {
+		return
+	}
+	s.lastCertificateCheck = time.Now()
+	s.requestCertificate()
+	brokers := map[string]network.TLSStatus{
+		network.BrokerServer: network.GetTLSStatus(s.serviceConf.NetworkBroker),
+		network.BrokerLocal:  network.GetTLSStatus(s.serviceConf.LocalBroker),
+	}
+	for broker, status := range brokers {
+		for _, cert := range status.Expiring(s.conf.Protocol.CertificateWarning) {
+			if time.Since(s.certificateWarnings[broker+"/"+cert.Fingerprint]) < CertificateWarningPeriod {
+				continue
+			}
+			rlog.Warnf("Certificate %v of %v expires on %v", cert.Subject, cert.File, cert.NotAfter)
+			warning := CertificateWarning{
+				CertificateInfo: cert,
+				Mac:             s.mac,
+				Broker:          broker,
+			}
+			dump, err := warning.ToJSON()
+			if err != nil {
+				rlog.Error("Could not dump certificate warning " + err.Error())
+				continue
+			}
+			err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlCertificate, dump)
+			if err != nil {
+				rlog.Errorf("Could not send certificate warning to the server %v", err.Error())
+				continue
+			}
+			s.certificateWarnings[broker+"/"+cert.Fingerprint] = time.Now()
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/database"
+	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionConfig = "ReloadServiceConfig"
+)
+
+//link supervision goroutine of a broker connection
+type link struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+//release cancel the supervision without waiting for its goroutine, it may be connecting or probing
+//the broker; the network is renewed before supervising it again
+func (l link) release() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
+
+//stop cancel the supervision and wait for its goroutine
+func (l link) stop() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+}
+
+func (s *CoreService) superviseServer() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.serverLink = link{cancel: cancel, done: make(chan struct{})}
+	go func(conf pkg.ServiceConfig, done chan struct{}) {
+		defer close(done)
+		s.server.Supervise(ctx, conf, s.clientID, s.mac)
+	}(s.serviceConf, s.serverLink.done)
+}
+
+func (s *CoreService) superviseLocal() {
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.localLink = link{cancel: cancel, done: make(chan struct{})}
+	go func(conf pkg.ServiceConfig, done chan struct{}) {
+		defer close(done)
+		s.local.Supervise(ctx, conf, s.clientID, s.mac)
+	}(s.serviceConf, s.localLink.done)
+}
+
+//Reload ask the main loop to reload the service configuration file (SIGHUP)
+func (s *CoreService) Reload() {
+	if s.ctx == nil {
+		return
+	}
+	s.trigger(ActionConfig)
+}
+
+func configModTime(confFile string) time.Time {
+	if confFile == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(confFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+//cronConfig watch the configuration file and reload it when modified
+func (s *CoreService) cronConfig() {
+	if s.confFile == "" || s.conf.Reload.WatchPeriod <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.conf.Reload.WatchPeriod) * time.Second)
+	defer ticker.Stop()
+	modTime := s.configModTime
+	for {
+		select {
+		case <-ticker.C:
+			current := configModTime(s.confFile)
+			if current.IsZero() || current.Equal(modTime) {
+				continue
+			}
+			modTime = current
+			rlog.Info("Configuration file " + s.confFile + " modified")
+			s.trigger(ActionConfig)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//reloadConfig apply the service configuration file, only the modified links are reconnected
+func (s *CoreService) reloadConfig() {
+	conf, err := pkg.ReadServiceConfig(s.confFile)
+	if err != nil {
+		rlog.Error("Cannot reload configuration file, keep the current one " + err.Error())
+		return
+	}
+	s.openKeystore()
+	err = s.resolveCredentials(conf)
+	if err != nil {
+		rlog.Error("Cannot read credentials, keep the current configuration " + err.Error())
+		return
+	}
+	s.applyCredentialsTrial(conf)
+	s.brokerKeyPath = conf.NetworkBroker.KeyPath
+	s.useClientCertificate(conf)
+	previous := s.serviceConf
+	s.serviceConf = *conf
+	rlog.Info("Reload configuration file " + s.confFile)
+
+	if conf.LogLevel != previous.LogLevel {
+		s.setLogLevel(conf.LogLevel)
+		rlog.Info("Log level set to " + conf.LogLevel)
+	}
+
+	if conf.DB != previous.DB {
+		db, err := database.ConnectDatabase(conf.DB.ClientIP, conf.DB.ClientPort)
+		if err != nil {
+			rlog.Error("Cannot connect to database " + conf.DB.ClientIP + ", keep the current one " + err.Error())
+			s.serviceConf.DB = previous.DB
+		} else {
+			s.db.Close()
+			s.db = *db
+			rlog.Info("Database switched to " + conf.DB.ClientIP)
+		}
+	}
+
+	if conf.LocalBroker != previous.LocalBroker {
+		s.reconnectLocal()
+	}
+
+	serverChanged := s.reloadCoreConfig()
+	if conf.NetworkBroker != previous.NetworkBroker || serverChanged {
+		s.reconnectServer()
+	}
+}
+
+//loadServerSecurity build the server commands signature verifier and authorization policy
+func loadServerSecurity(conf config.CoreConfig) (*network.Verifier, *network.Policy, error) {
+	var verifier *network.Verifier
+	var policy *network.Policy
+	var err error
+	if conf.Security.RequireSignature {
+		verifier, err = network.NewVerifier(conf.Security)
+		if err != nil {
+			return nil, nil, errors.New("Cannot load trust store " + conf.Security.TrustStore + " error: " + err.Error())
+		}
+	}
+	if conf.Authorization.PolicyFile != "" {
+		policy, err = network.LoadPolicy(conf.Authorization.PolicyFile)
+		if err != nil {
+			return nil, nil, errors.New("Cannot load policy " + conf.Authorization.PolicyFile + " error: " + err.Error())
+		}
+	}
+	return verifier, policy, nil
+}
+
+//reloadCoreConfig apply the core section of the configuration file: the server commands settings
+//are applied live, the sections read at startup only keep their current value until a restart.
+//It returns true when the server connection must be restarted to use the new settings.
+func (s *CoreService) reloadCoreConfig() bool {
+	next, err := config.ReadCoreConfig(s.confFile)
+	if err != nil {
+		rlog.Error("Cannot reload core configuration, keep the current one " + err.Error())
+		return false
+	}
+	current := s.conf
+
+	//sections only read at startup
+	static := []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"audit", &current.Audit, &next.Audit},
+		{"metrics", &current.Metrics, &next.Metrics},
+		{"watchdog", &current.Watchdog, &next.Watchdog},
+		{"alarm", &current.Alarm, &next.Alarm},
+		{"schedule", &current.Schedule, &next.Schedule},
+		{"reload", &current.Reload, &next.Reload},
+		{"logs", &current.Logs, &next.Logs},
+		{"identity", &current.Identity, &next.Identity},
+		{"certificates", &current.Certificates, &next.Certificates},
+		{"secrets", &current.Secrets, &next.Secrets},
+	}
+	var restart []string
+	for _, section := range static {
+		currentValue := reflect.ValueOf(section.current).Elem()
+		nextValue := reflect.ValueOf(section.next).Elem()
+		if !reflect.DeepEqual(currentValue.Interface(), nextValue.Interface()) {
+			restart = append(restart, section.name)
+			nextValue.Set(currentValue)
+		}
+	}
+	//the fallback timeouts are read live, not its files and topic
+	if next.Fallback.ScenarioFile != current.Fallback.ScenarioFile ||
+		next.Fallback.GroupsFile != current.Fallback.GroupsFile ||
+		next.Fallback.ServerTopic != current.Fallback.ServerTopic {
+		restart = append(restart, "fallback")
+		next.Fallback = current.Fallback
+	}
+	if len(restart) > 0 {
+		rlog.Warn("Core configuration sections " + strings.Join(restart, ", ") + " changed, they are applied on the next service restart")
+	}
+
+	//the trust store and the policy file may have changed without the configuration
+	verifier, policy, err := loadServerSecurity(*next)
+	if err != nil {
+		rlog.Error(err.Error() + ", keep the current server commands settings")
+		next.Validation = current.Validation
+		next.Security = current.Security
+		next.Authorization = current.Authorization
+		s.conf = *next
+		return false
+	}
+	s.conf = *next
+	if reflect.DeepEqual(next.Validation, s.server.Validation) &&
+		verifier.Equal(s.server.Verifier) &&
+		reflect.DeepEqual(policy, s.server.Policy) {
+		return false
+	}
+	rlog.Info("Server commands validation, trust store or policy changed")
+	verifier.Inherit(s.server.Verifier)
+	s.server.Validation = next.Validation
+	s.server.Verifier = verifier
+	s.server.Policy = policy
+	return true
+}
+
+//reconnectLocal reconnect the drivers broker and restart its supervision with the current settings
+func (s *CoreService) reconnectLocal() {
+	rlog.Info("Reconnect drivers broker " + s.serviceConf.LocalBroker.IP)
+	s.localLink.release()
+	s.local.Disconnect()
+	err := s.local.Renew()
+	if err != nil {
+		rlog.Error("Cannot create drivers broker network " + err.Error())
+	}
+	err = s.local.LocalConnection(s.serviceConf, s.clientID, s.mac)
+	if err != nil {
+		//the supervision reconnects it
+		rlog.Error("Cannot connect to drivers broker " + s.serviceConf.LocalBroker.IP + " error: " + err.Error())
+		s.onLocalState(network.LocalDisconnected)
+	} else {
+		s.onLocalState(network.LocalConnected)
+	}
+	s.superviseLocal()
+}
+
+//reconnectServer restart the server broker supervision with the current settings
+func (s *CoreService) reconnectServer() {
+	rlog.Info("Reconnect server broker " + s.serviceConf.NetworkBroker.IP)
+	s.serverLink.release()
+	s.server.Disconnect()
+	err := s.server.Renew()
+	if err != nil {
+		rlog.Error("Cannot create server broker network " + err.Error())
+	}
+	s.onServerState(network.BrokerDisconnected)
+	s.superviseServer()
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/energieip/swh200-coreservice-go/internal/schedule"
+	"github.com/romana/rlog"
+)
+
+const (
+	ActionSchedule = "Schedule"
+
+	//minutes missed while the service was busy are run late up to this delay
+	scheduleCatchUp = time.Hour
+)
+
+//loadSchedule restore the schedule received from the server before the restart
+func (s *CoreService) loadSchedule() {
+	err := core.LoadJSON(s.conf.Schedule.File, &s.schedule)
+	if err != nil {
+		rlog.Error("Cannot load schedule " + err.Error())
+	}
+}
+
+func (s *CoreService) setSchedule(sched schedule.Schedule) {
+	s.schedule = sched
+	err := core.SaveJSON(s.conf.Schedule.File, sched)
+	if err != nil {
+		rlog.Error("Cannot save schedule " + err.Error())
+	}
+	rlog.Infof("Schedule updated with %v entries", len(sched.Entries))
+}
+
+//cronSchedule trigger the schedule at the beginning of every minute
+func (s *CoreService) cronSchedule() {
+	for {
+		now := time.Now()
+		select {
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+			s.trigger(ActionSchedule)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//scheduleMinutes return the minutes to run after the last run up to now, at most scheduleCatchUp late
+func scheduleMinutes(last, now time.Time) []time.Time {
+	now = now.Truncate(time.Minute)
+	minute := last.Add(time.Minute)
+	if last.IsZero() {
+		minute = now
+	} else if now.Sub(minute) > scheduleCatchUp {
+		rlog.Warnf("Schedule late since %v, skip to %v", minute.Format(time.RFC3339),
+			now.Add(-scheduleCatchUp).Format(time.RFC3339))
+		minute = now.Add(-scheduleCatchUp)
+	}
+	var minutes []time.Time
+	for ; !minute.After(now); minute = minute.Add(time.Minute) {
+		minutes = append(minutes, minute)
+	}
+	return minutes
+}
+
+//runSchedule run the entries due since the last run, including the minutes elapsed while the
+//main loop was busy
+func (s *CoreService) runSchedule() {
+	now := time.Now().Truncate(time.Minute)
+	for _, minute := range scheduleMinutes(s.lastSchedule, now) {
+		for _, entry := range s.schedule.Due(minute) {
+			if minute.Before(now) {
+				rlog.Info("Run late scheduled scenario " + entry.ID + " of " + minute.Format(time.RFC3339))
+			} else {
+				rlog.Info("Run scheduled scenario " + entry.ID)
+			}
+			s.audit.Record(audit.Entry{
+				Category: audit.CategoryCommand,
+				Action:   "schedule",
+				Target:   entry.ID,
+				Details:  minute.Format(time.RFC3339),
+			})
+			s.sendGroupSettings(entry.Groups)
+		}
+		s.lastSchedule = minute
+	}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleMinutes(t *testing.T) {
+	now := time.Date(2024, time.January, 9, 12, 0, 30, 0, time.UTC)
+	minute := now.Truncate(time.Minute)
+	tests := []struct {
+		name  string
+		last  time.Time
+		first time.Time
+		count int
+	}{
+		{"first run", time.Time{}, minute, 1},
+		{"on time", minute.Add(-time.Minute), minute, 1},
+		{"already run", minute, time.Time{}, 0},
+		{"late", minute.Add(-5 * time.Minute), minute.Add(-4 * time.Minute), 5},
+		{"catch up limit", minute.Add(-scheduleCatchUp), minute.Add(-scheduleCatchUp + time.Minute), 60},
+		{"too late", minute.Add(-3 * time.Hour), minute.Add(-scheduleCatchUp), 61},
+	}
+	for _, test := range tests {
+		minutes := scheduleMinutes(test.last, now)
+		if len(minutes) != test.count {
+			t.Errorf("%s: %v minutes, want %v", test.name, len(minutes), test.count)
+			continue
+		}
+		if test.count == 0 {
+			continue
+		}
+		if !minutes[0].Equal(test.first) {
+			t.Errorf("%s: first minute %v, want %v", test.name, minutes[0], test.first)
+		}
+		if !minutes[len(minutes)-1].Equal(minute) {
+			t.Errorf("%s: last minute %v, want %v", test.name, minutes[len(minutes)-1], minute)
+		}
+		for i := 1; i < len(minutes); i++ {
+			if minutes[i].Sub(minutes[i-1]) != time.Minute {
+				t.Errorf("%s: minutes %v and %v are not consecutive", test.name, minutes[i-1], minutes[i])
+				break
+			}
+		}
+	}
+}
@@ -1,19 +1,29 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
+	gm "github.com/energieip/common-group-go/pkg/groupmodel"
 	dl "github.com/energieip/common-led-go/pkg/driverled"
 	ds "github.com/energieip/common-sensor-go/pkg/driversensor"
 	pkg "github.com/energieip/common-service-go/pkg/service"
 	sd "github.com/energieip/common-switch-go/pkg/deviceswitch"
-	"github.com/energieip/common-tools-go/pkg/tools"
+	"github.com/energieip/swh200-coreservice-go/internal/alarm"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/config"
 	"github.com/energieip/swh200-coreservice-go/internal/core"
 	"github.com/energieip/swh200-coreservice-go/internal/database"
+	"github.com/energieip/swh200-coreservice-go/internal/logs"
+	"github.com/energieip/swh200-coreservice-go/internal/metrics"
 	"github.com/energieip/swh200-coreservice-go/internal/network"
+	"github.com/energieip/swh200-coreservice-go/internal/pki"
+	"github.com/energieip/swh200-coreservice-go/internal/schedule"
+	"github.com/energieip/swh200-coreservice-go/internal/secrets"
+	"github.com/energieip/swh200-coreservice-go/internal/watchdog"
 	"github.com/romana/rlog"
 )
 
@@ -23,53 +33,169 @@ const (
 	ActionDump   = "DumpStatus"
 	ActionRemove = "remove"
 
-	UrlStatus = "status/dump"
-	UrlHello  = "setup/hello"
+	UrlStatus   = "status/dump"
+	UrlHost     = "status/host"
+	UrlHello    = "setup/hello"
+	UrlRejected = "setup/rejected"
+	UrlAudit    = "audit/entries"
+	UrlService  = "service/result"
+	UrlWatchdog = "service/alarm"
+	UrlDriver   = "driver/alarm"
+
+	DevicesLed    = "led"
+	DevicesSensor = "sensor"
+
+	DefaultLogLines = 50
 
 	TimerDump = 10
 )
 
 //CoreService content
 type CoreService struct {
-	server                network.ServerNetwork //Remote server
-	local                 network.LocalNetwork  //local broker for drivers and services
-	db                    database.Database
-	mac                   string //Switch mac address
-	events                chan string
-	timerDump             time.Duration //in seconds
-	ip                    string
-	isConfigured          bool
-	groups                map[int]bool
-	services              map[string]pkg.Service
-	lastSystemUpgradeDate string
-	friendlyName          string
+	server                 network.ServerNetwork //Remote server
+	local                  network.LocalNetwork  //local broker for drivers and services
+	db                     database.Database
+	mac                    string //Switch mac address
+	events                 chan string
+	timerDump              time.Duration //in seconds
+	ip                     string
+	isConfigured           bool
+	groups                 map[int]bool
+	services               map[string]pkg.Service
+	lastSystemUpgradeDate  string
+	friendlyName           string
+	conf                   config.CoreConfig
+	audit                  *audit.Logger
+	watchdog               *watchdog.Watchdog
+	localState             string          //drivers broker state
+	lastConfig             sd.SwitchConfig //configuration applied to the drivers
+	drivers                map[string]DriverPresence
+	discovered             map[string]bool //unconfigured devices already reported
+	alarms                 *alarm.Engine
+	serverState            string
+	serverLostAt           time.Time
+	fallbackActive         bool
+	fallbackGroups         map[int]gm.GroupConfig
+	schedule               schedule.Schedule
+	lastSchedule           time.Time
+	ctx                    context.Context //canceled when the service stops
+	cancel                 context.CancelFunc
+	done                   chan struct{} //closed once the main loop has shut down
+	closeOnce              sync.Once
+	confFile               string
+	clientID               string
+	serviceConf            pkg.ServiceConfig
+	configModTime          time.Time
+	serverLink             link //server broker supervision
+	logs                   *logs.Buffer
+	lastDump               string //last status sent to the server
+	diagnosing             int32  //set while a diagnostics archive is uploaded
+	updating               int32  //set once a core update is downloaded or handed over
+	started                time.Time
+	lastCertificateCheck   time.Time
+	certificateWarnings    map[string]time.Time //broker/fingerprint: last warning sent
+	pki                    *pki.Store           //nil when the certificate provisioning is disabled
+	brokerKeyPath          string               //server broker key from the configuration file
+	certificateTrial       bool                 //new certificate not validated by a server connection yet
+	keystore               *secrets.Keystore
+	credentialsTrial       *credentialsTrial //rotated credentials not validated by a broker connection yet
+	lastCertificateRequest time.Time
+	localLink              link //drivers broker supervision
+	offlineOnce            sync.Once
+}
+
+//DriverPresence last hello received from a driver
+type DriverPresence struct {
+	Version  string `json:"version"`
+	LastSeen string `json:"lastSeen"`
+	State    string `json:"state"` //present or lost
+}
+
+//Driver presence states
+const (
+	DriverPresent = "present"
+	DriverLost    = "lost"
+)
+
+//switchStatus status dump completed with the core service view
+type switchStatus struct {
+	sd.SwitchStatus
+	Services        map[string]serviceStatus  `json:"services"`
+	DegradedDevices map[string]string         `json:"degradedDevices,omitempty"` //device mac: reason
+	LocalBroker     string                    `json:"localBroker"`
+	Drivers         map[string]DriverPresence `json:"drivers"`
+}
+
+//serviceStatus service status completed with its systemd health when known
+type serviceStatus struct {
+	pkg.ServiceStatus
+	*core.ServiceHealth
 }
 
 //Initialize service
 func (s *CoreService) Initialize(confFile string) error {
 	hostname, _ := os.Hostname()
 	clientID := "Switch" + hostname
+	s.clientID = clientID
+	s.confFile = confFile
 	s.events = make(chan string)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.done = make(chan struct{})
+	s.started = time.Now()
 
 	conf, err := pkg.ReadServiceConfig(confFile)
 	if err != nil {
 		rlog.Error("Cannot parse configuration file " + err.Error())
 		return err
 	}
+	s.configModTime = configModTime(confFile)
+
+	coreConf, err := config.ReadCoreConfig(confFile)
+	if err != nil {
+		rlog.Error("Cannot parse core configuration " + err.Error())
+		return err
+	}
+	s.conf = *coreConf
 
-	mac, ip := tools.GetNetworkInfo()
-	s.ip = ip
-	s.mac = strings.ToUpper(mac[9:])
+	s.openKeystore()
+	err = s.resolveCredentials(conf)
+	if err != nil {
+		rlog.Error("Cannot read credentials " + err.Error())
+		return err
+	}
+	s.serviceConf = *conf
+
+	err = s.initIdentity()
+	if err != nil {
+		rlog.Error(err.Error())
+		return err
+	}
 	s.groups = make(map[int]bool)
 	s.services = make(map[string]pkg.Service)
+	s.drivers = make(map[string]DriverPresence)
+	s.discovered = make(map[string]bool)
+	s.certificateWarnings = make(map[string]time.Time)
+	s.discoverServices()
 
-	os.Setenv("RLOG_LOG_LEVEL", conf.LogLevel)
+	s.logs = logs.NewBuffer(s.conf.Logs.BufferLines, os.Stderr)
 	os.Setenv("RLOG_LOG_NOTIME", "yes")
-	rlog.UpdateEnv()
+	s.setLogLevel(conf.LogLevel)
 	rlog.Info("Starting SwitchCore service")
 
 	s.timerDump = TimerDump
 
+	if s.conf.Metrics.Address != "" {
+		go metrics.Serve(s.conf.Metrics.Address)
+	}
+
+	auditLog, err := audit.NewLogger(s.conf.Audit)
+	if err != nil {
+		//keep running without audit rather than leaving the switch unmanaged
+		rlog.Error("Cannot open audit log " + s.conf.Audit.File + " error: " + err.Error())
+	} else {
+		s.audit = auditLog
+	}
+
 	db, err := database.ConnectDatabase(conf.DB.ClientIP, conf.DB.ClientPort)
 	if err != nil {
 		rlog.Error("Cannot connect to database " + err.Error())
@@ -77,46 +203,66 @@ func (s *CoreService) Initialize(confFile string) error {
 	}
 	s.db = *db
 
-	serverNet, err := network.CreateServerNetwork()
+	serverNet, err := network.CreateServerNetwork(s.ctx)
 	if err != nil {
 		rlog.Error("Cannot connect to broker " + conf.LocalBroker.IP + " error: " + err.Error())
 		return err
 	}
+	version := ""
+	if v := pkg.GetPackageVersion(core.CorePackage); v != nil {
+		version = *v
+	}
+	serverNet.Presence = network.NewPresence(s.mac, s.ip, version)
+	serverNet.Mac = s.mac
+	serverNet.ServerTopic = s.conf.Fallback.ServerTopic
+	serverNet.Validation = s.conf.Validation
+	serverNet.Audit = s.audit
+	serverNet.Verifier, serverNet.Policy, err = loadServerSecurity(s.conf)
+	if err != nil {
+		rlog.Error(err.Error())
+		return err
+	}
 	s.server = *serverNet
 
-	driversNet, err := network.CreateLocalNetwork()
+	driversNet, err := network.CreateLocalNetwork(s.ctx)
 	if err != nil {
 		rlog.Error("Cannot connect to broker " + conf.NetworkBroker.IP + " error: " + err.Error())
 		return err
 	}
 	s.local = *driversNet
 
-	err = s.local.LocalConnection(*conf, clientID, s.mac)
+	err = s.local.LocalConnection(s.serviceConf, clientID, s.mac)
 	if err != nil {
 		rlog.Error("Cannot connect to drivers broker " + conf.LocalBroker.IP + " error: " + err.Error())
 		return err
 	}
-
-	go s.server.RemoteServerConnection(*conf, clientID, s.mac)
+	s.localState = network.LocalConnected
+	s.superviseLocal()
+
+	s.watchdog = watchdog.NewWatchdog(s.conf.Watchdog)
+	s.loadAlarmRules()
+	s.loadFallbackScenario()
+	s.loadSchedule()
+	s.serverState = network.BrokerDisconnected
+	s.serverLostAt = time.Now()
+	s.scheduleFallback()
+
+	s.initCertificates()
+	s.superviseServer()
 	rlog.Info("SwitchCore service started")
 	return nil
 }
 
-//Stop service
-func (s *CoreService) Stop() {
-	rlog.Info("Stopping SwitchCore service")
-	s.server.Disconnect()
-	s.local.Disconnect()
-	s.db.Close()
-	rlog.Info("SwitchCore service stopped")
-}
-
 func (s *CoreService) sendHello() {
-	switchDump := sd.Switch{
-		Mac:          s.mac,
-		IP:           s.ip,
-		IsConfigured: &s.isConfigured,
-		Protocol:     "MQTTS",
+	switchDump := switchHello{
+		Switch: sd.Switch{
+			Mac:          s.mac,
+			IP:           s.ip,
+			IsConfigured: &s.isConfigured,
+			Protocol:     s.protocol(),
+		},
+		TLS: network.GetTLSStatus(s.serviceConf.NetworkBroker),
+		Csr: s.certificateRequest(),
 	}
 	dump, err := switchDump.ToJSON()
 	if err != nil {
@@ -130,24 +276,36 @@ func (s *CoreService) sendHello() {
 		return
 	}
 	rlog.Infof("Hello %v sent to the server", s.mac)
+	if switchDump.Csr != nil {
+		s.lastCertificateRequest = time.Now()
+		rlog.Info("Certificate request (" + switchDump.Csr.Reason + ") sent to the server")
+	}
 }
 
 func (s *CoreService) sendDump() {
+	defer metrics.DumpDuration.ObserveSince(time.Now())
 	status := sd.SwitchStatus{}
 	status.Mac = s.mac
-	status.Protocol = "MQTTS"
+	status.Protocol = s.protocol()
 	status.IP = s.ip
 	status.IsConfigured = &s.isConfigured
 	status.FriendlyName = s.friendlyName
 	services := make(map[string]pkg.ServiceStatus)
+	healths := make(map[string]core.ServiceHealth)
 
 	for _, c := range s.services {
 		component := pkg.ServiceStatus{}
 		component.Name = c.Name
 		component.PackageName = c.PackageName
 		component.Version = c.Version
-		status := component.GetServiceStatus()
-		component.Status = &status
+		health, err := core.GetServiceHealth(c.PackageName)
+		if err == nil {
+			healths[component.Name] = *health
+			component.Status = &health.ActiveState
+		} else {
+			status := component.GetServiceStatus()
+			component.Status = &status
+		}
 		services[component.Name] = component
 	}
 
@@ -155,12 +313,16 @@ func (s *CoreService) sendDump() {
 	status.Leds = database.GetSwitchLeds(s.db, s.mac)
 	status.Sensors = database.GetSwitchSensors(s.db, s.mac)
 	status.Groups = database.GetStatusGroup(s.db, s.groups)
+	s.evaluateAlarms(status)
+	s.checkDiscoveries(status.Leds, status.Sensors)
 
-	dump, err := status.ToJSON()
+	dump, err := s.completeStatus(status, healths).ToJSON()
 	if err != nil {
 		rlog.Error("Could not dump switch status ", err.Error())
 		return
 	}
+	metrics.DumpSize.Observe(float64(len(dump)))
+	s.lastDump = dump
 
 	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlStatus, dump)
 	if err != nil {
@@ -168,29 +330,256 @@ func (s *CoreService) sendDump() {
 		return
 	}
 	rlog.Infof("Status %v sent to the server", s.mac)
+	s.sendHostStatus(healths)
+}
+
+func (s *CoreService) completeStatus(status sd.SwitchStatus, healths map[string]core.ServiceHealth) switchStatus {
+	full := switchStatus{
+		SwitchStatus:    status,
+		Services:        make(map[string]serviceStatus),
+		DegradedDevices: make(map[string]string),
+		LocalBroker:     s.localState,
+		Drivers:         make(map[string]DriverPresence),
+	}
+	for driver, presence := range s.drivers {
+		full.Drivers[driver] = presence
+	}
+	for name, service := range status.Services {
+		entry := serviceStatus{ServiceStatus: service}
+		if health, ok := healths[name]; ok {
+			entry.ServiceHealth = &health
+		}
+		full.Services[name] = entry
+	}
+	for unit, service := range s.watchdog.Unhealthy() {
+		//a crashed driver cannot announce its loss
+		if presence, ok := full.Drivers[service.Devices]; ok {
+			presence.State = DriverLost
+			full.Drivers[service.Devices] = presence
+		}
+		switch service.Devices {
+		case DevicesLed:
+			for mac := range status.Leds {
+				full.DegradedDevices[mac] = unit + " unhealthy"
+			}
+		case DevicesSensor:
+			for mac := range status.Sensors {
+				full.DegradedDevices[mac] = unit + " unhealthy"
+			}
+		}
+	}
+	return full
+}
+
+//ToJSON dump switch status struct
+func (status switchStatus) ToJSON() (string, error) {
+	inrec, err := json.Marshal(status)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+func (s *CoreService) sendWatchdogEvent(event watchdog.Event) {
+	switch event.Type {
+	case watchdog.EventRestarted:
+		entry := audit.Entry{
+			Category: audit.CategoryService,
+			Action:   "watchdog restart",
+			Target:   event.Unit,
+			Details:  event.Reason,
+		}
+		s.audit.Record(entry)
+	case watchdog.EventRecovered:
+		rlog.Info("Watchdog: " + event.Unit + " recovered")
+	}
+
+	event.Mac = s.mac
+	dump, err := event.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump watchdog event " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlWatchdog, dump)
+	if err != nil {
+		rlog.Errorf("Could not send watchdog event to the server %v status %v", s.mac, err.Error())
+	}
+}
+
+func (s *CoreService) sendHostStatus(services map[string]core.ServiceHealth) {
+	host := core.GetHostStatus()
+	host.Mac = s.mac
+	host.Services = services
+	dump, err := host.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump host status ", err.Error())
+		return
+	}
+
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlHost, dump)
+	if err != nil {
+		rlog.Errorf("Could not send host status %v status %v", s.mac, err.Error())
+		return
+	}
+	rlog.Infof("Host status %v sent to the server", s.mac)
+}
+
+//discoverServices register the energieip services installed before the service started
+func (s *CoreService) discoverServices() {
+	for packageName, version := range core.GetInstalledPackages() {
+		service := pkg.Service{
+			Name:        packageName,
+			PackageName: packageName,
+			Version:     version,
+		}
+		s.services[service.Name] = service
+		rlog.Info("Found installed service " + packageName + " in version " + version)
+	}
+}
+
+//findService return the unit of a switch service known by name or package name
+func (s *CoreService) findService(name string) (string, bool) {
+	if service, ok := s.services[name]; ok {
+		return service.PackageName, true
+	}
+	for _, service := range s.services {
+		if service.PackageName == name {
+			return service.PackageName, true
+		}
+	}
+	return "", false
+}
+
+func (s *CoreService) runServiceCommand(cmd network.ServiceCommand) {
+	result := network.ServiceCommandResult{
+		Mac:     s.mac,
+		ID:      cmd.ID,
+		Service: cmd.Service,
+		Action:  cmd.Action,
+	}
+	unit, ok := s.findService(cmd.Service)
+	if !ok {
+		result.Error = "unknown service " + cmd.Service
+	} else if unit == core.CorePackage && cmd.Action != network.ServiceLogs {
+		//the core could not report the result, it is updated by its own command
+		result.Error = cmd.Action + " is not allowed on the core service"
+	} else {
+		var err error
+		if cmd.Action == network.ServiceLogs {
+			lines := cmd.Lines
+			if lines == 0 {
+				lines = DefaultLogLines
+			}
+			result.Output, err = core.GetServiceLogs(unit, lines)
+		} else {
+			rlog.Info("Service " + unit + ": " + cmd.Action)
+			stopping := cmd.Action == network.ServiceStop || cmd.Action == network.ServiceDisable
+			if stopping {
+				//keep the watchdog from restarting it
+				s.watchdog.Pause(unit)
+			}
+			result.Output, err = core.ServiceAction(unit, cmd.Action)
+			if (stopping && err != nil) ||
+				(!stopping && err == nil && cmd.Action != network.ServiceEnable) {
+				s.watchdog.Resume(unit)
+			}
+			entry := audit.Entry{
+				Category: audit.CategoryService,
+				Action:   cmd.Action,
+				Target:   unit,
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			s.audit.Record(entry)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	result.Success = result.Error == ""
+
+	dump, err := result.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump service command result " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlService, dump)
+	if err != nil {
+		rlog.Errorf("Could not send service result to the server %v status %v", s.mac, err.Error())
+	}
+}
+
+func (s *CoreService) sendRejection(rejection network.Rejection) {
+	rejection.Mac = s.mac
+	dump, err := rejection.ToJSON()
+	if err != nil {
+		rlog.Errorf("Could not dump switch %v rejection %v", s.mac, err.Error())
+		return
+	}
+
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlRejected, dump)
+	if err != nil {
+		rlog.Errorf("Could not send rejection to the server %v status %v", s.mac, err.Error())
+		return
+	}
+	rlog.Warnf("Command %v on %v rejected: %v", rejection.Command, rejection.Topic, rejection.Reason)
+}
+
+func (s *CoreService) sendAuditEntries(query audit.Query) {
+	entries, err := audit.Read(s.conf.Audit, query)
+	if err != nil {
+		rlog.Error("Could not read audit log " + err.Error())
+		return
+	}
+	dump, err := audit.ToJSON(entries)
+	if err != nil {
+		rlog.Error("Could not dump audit entries " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlAudit, dump)
+	if err != nil {
+		rlog.Errorf("Could not send audit entries to the server %v status %v", s.mac, err.Error())
+		return
+	}
+	rlog.Infof("%v audit entries sent to the server", len(entries))
+}
+
+//sendDriverCommand forward a command to the drivers and audit it
+func (s *CoreService) sendDriverCommand(url, content string) {
+	err := s.local.SendCommand(url, content)
+	entry := audit.Entry{
+		Category: audit.CategoryDriver,
+		Action:   url,
+		Details:  content,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit.Record(entry)
 }
 
 func (s *CoreService) updateConfiguration(switchConfig sd.SwitchConfig) {
 	for _, led := range switchConfig.LedsSetup {
 		url := "/write/switch/led/setup/config"
 		ledDump, _ := led.ToJSON()
-		s.local.SendCommand(url, ledDump)
+		s.sendDriverCommand(url, ledDump)
 	}
 	for _, led := range switchConfig.LedsConfig {
 		url := "/write/switch/led/update/settings"
 		ledDump, _ := led.ToJSON()
-		s.local.SendCommand(url, ledDump)
+		s.sendDriverCommand(url, ledDump)
 	}
 
 	for _, sensor := range switchConfig.SensorsSetup {
 		url := "/write/switch/sensor/setup/config"
 		sensorDump, _ := sensor.ToJSON()
-		s.local.SendCommand(url, sensorDump)
+		s.sendDriverCommand(url, sensorDump)
 	}
 	for _, sensor := range switchConfig.SensorsConfig {
 		url := "/write/switch/sensor/update/settings"
 		sensorDump, _ := sensor.ToJSON()
-		s.local.SendCommand(url, sensorDump)
+		s.sendDriverCommand(url, sensorDump)
 	}
 
 	for grID := range switchConfig.Groups {
@@ -200,15 +589,158 @@ func (s *CoreService) updateConfiguration(switchConfig sd.SwitchConfig) {
 		}
 	}
 	if len(switchConfig.Groups) > 0 {
-		url := "/write/switch/group/update/settings"
+		url := UrlGroupSettings
 		inrec, err := json.Marshal(switchConfig.Groups)
 		if err == nil {
 			dump := string(inrec[:])
-			s.local.SendCommand(url, dump)
+			s.sendDriverCommand(url, dump)
+		}
+	}
+}
+
+//cacheConfiguration keep the applied configuration to restore the drivers after a broker loss
+func (s *CoreService) cacheConfiguration(switchConfig sd.SwitchConfig) {
+	if s.lastConfig.LedsSetup == nil {
+		s.lastConfig.LedsSetup = make(map[string]dl.LedSetup)
+		s.lastConfig.LedsConfig = make(map[string]dl.LedConf)
+		s.lastConfig.SensorsSetup = make(map[string]ds.SensorSetup)
+		s.lastConfig.SensorsConfig = make(map[string]ds.SensorConf)
+		s.lastConfig.Groups = make(map[int]gm.GroupConfig)
+	}
+	for mac, led := range switchConfig.LedsSetup {
+		s.lastConfig.LedsSetup[mac] = led
+	}
+	for mac, led := range switchConfig.LedsConfig {
+		s.lastConfig.LedsConfig[mac] = led
+	}
+	for mac, sensor := range switchConfig.SensorsSetup {
+		s.lastConfig.SensorsSetup[mac] = sensor
+	}
+	for mac, sensor := range switchConfig.SensorsConfig {
+		s.lastConfig.SensorsConfig[mac] = sensor
+	}
+	for grID, group := range switchConfig.Groups {
+		s.lastConfig.Groups[grID] = group
+	}
+	if len(switchConfig.Groups) > 0 {
+		s.saveServerGroups()
+	}
+}
+
+//uncacheConfiguration forget the removed devices and groups
+func (s *CoreService) uncacheConfiguration(switchConfig sd.SwitchConfig) {
+	for mac := range switchConfig.LedsConfig {
+		delete(s.lastConfig.LedsSetup, mac)
+		delete(s.lastConfig.LedsConfig, mac)
+	}
+	for mac := range switchConfig.SensorsConfig {
+		delete(s.lastConfig.SensorsSetup, mac)
+		delete(s.lastConfig.SensorsConfig, mac)
+	}
+	for grID := range switchConfig.Groups {
+		delete(s.lastConfig.Groups, grID)
+	}
+	if len(switchConfig.Groups) > 0 {
+		s.saveServerGroups()
+	}
+}
+
+func (s *CoreService) onLocalState(state string) {
+	s.localState = state
+	rlog.Info("Drivers broker " + state)
+	if state == network.LocalConnected {
+		s.credentialsValidated(network.BrokerLocal)
+		rlog.Info("Restore drivers configuration")
+		s.updateConfiguration(s.lastConfig)
+	}
+}
+
+func (s *CoreService) onDriverEvent(event network.DriverEvent) {
+	switch event.Type {
+	case network.DriverHello:
+		s.drivers[event.Driver] = DriverPresence{
+			Version:  event.Version,
+			LastSeen: time.Now().UTC().Format(time.RFC3339),
+			State:    DriverPresent,
+		}
+		rlog.Info("Driver " + event.Driver + " " + event.Version + " is present, send its configuration")
+		s.configureDriver(event.Driver)
+
+	case network.DriverDiscovered:
+		s.configureDevice(event.Driver, event.Mac)
+		s.checkDiscovery(event.Driver, event.Mac)
+
+	case network.DriverLost, network.DriverError:
+		if presence, ok := s.drivers[event.Driver]; ok && event.Type == network.DriverLost && event.Mac == "" {
+			//the driver itself, not one of its devices
+			presence.State = DriverLost
+			s.drivers[event.Driver] = presence
+			rlog.Warn("Driver " + event.Driver + " lost")
+		}
+		alarm := network.DriverAlarm{
+			DriverEvent: event,
+			SwitchMac:   s.mac,
+		}
+		dump, err := alarm.ToJSON()
+		if err != nil {
+			rlog.Error("Could not dump driver alarm " + err.Error())
+			return
+		}
+		err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlDriver, dump)
+		if err != nil {
+			rlog.Errorf("Could not send driver alarm to the server %v status %v", s.mac, err.Error())
 		}
 	}
 }
 
+//configureDriver send the cached configuration of every device handled by the driver
+func (s *CoreService) configureDriver(driver string) {
+	switchConfig := sd.SwitchConfig{}
+	switch driver {
+	case DevicesLed:
+		switchConfig.LedsSetup = s.lastConfig.LedsSetup
+		switchConfig.LedsConfig = s.lastConfig.LedsConfig
+	case DevicesSensor:
+		switchConfig.SensorsSetup = s.lastConfig.SensorsSetup
+		switchConfig.SensorsConfig = s.lastConfig.SensorsConfig
+	default:
+		return
+	}
+	s.updateConfiguration(switchConfig)
+}
+
+//configureDevice send the cached configuration of a newly discovered device
+func (s *CoreService) configureDevice(driver, mac string) {
+	switchConfig := sd.SwitchConfig{}
+	switch driver {
+	case DevicesLed:
+		switchConfig.LedsSetup = make(map[string]dl.LedSetup)
+		switchConfig.LedsConfig = make(map[string]dl.LedConf)
+		if setup, ok := s.lastConfig.LedsSetup[mac]; ok {
+			switchConfig.LedsSetup[mac] = setup
+		}
+		if conf, ok := s.lastConfig.LedsConfig[mac]; ok {
+			switchConfig.LedsConfig[mac] = conf
+		}
+	case DevicesSensor:
+		switchConfig.SensorsSetup = make(map[string]ds.SensorSetup)
+		switchConfig.SensorsConfig = make(map[string]ds.SensorConf)
+		if setup, ok := s.lastConfig.SensorsSetup[mac]; ok {
+			switchConfig.SensorsSetup[mac] = setup
+		}
+		if conf, ok := s.lastConfig.SensorsConfig[mac]; ok {
+			switchConfig.SensorsConfig[mac] = conf
+		}
+	}
+	if len(switchConfig.LedsSetup)+len(switchConfig.LedsConfig)+
+		len(switchConfig.SensorsSetup)+len(switchConfig.SensorsConfig) == 0 {
+		rlog.Info("No configuration known for discovered " + driver + " " + mac)
+		return
+	}
+	rlog.Info("Configure discovered " + driver + " " + mac)
+	s.updateConfiguration(switchConfig)
+}
+
 func (s *CoreService) removeConfiguration(switchConfig sd.SwitchConfig) {
 	for grID, group := range switchConfig.Groups {
 		_, ok := s.groups[grID]
@@ -217,7 +749,7 @@ func (s *CoreService) removeConfiguration(switchConfig sd.SwitchConfig) {
 		}
 		dump, _ := group.ToJSON()
 		url := "/remove/switch/group/update/settings"
-		s.local.SendCommand(url, dump)
+		s.sendDriverCommand(url, dump)
 	}
 
 	isConfigured := false
@@ -228,7 +760,7 @@ func (s *CoreService) removeConfiguration(switchConfig sd.SwitchConfig) {
 		}
 		dump, _ := remove.ToJSON()
 		url := "/write/switch/led/update/settings"
-		s.local.SendCommand(url, dump)
+		s.sendDriverCommand(url, dump)
 	}
 
 	for sensorMac := range switchConfig.SensorsConfig {
@@ -238,23 +770,39 @@ func (s *CoreService) removeConfiguration(switchConfig sd.SwitchConfig) {
 		}
 		dump, _ := remove.ToJSON()
 		url := "/write/switch/sensor/update/settings"
-		s.local.SendCommand(url, dump)
+		s.sendDriverCommand(url, dump)
 	}
+	s.forgetAlarmDevices(switchConfig)
 }
 
 func (s *CoreService) cronDump() {
 	timerDump := time.NewTicker(s.timerDump * time.Second)
+	defer timerDump.Stop()
 	for {
 		select {
 		case <-timerDump.C:
-			s.events <- ActionDump
+			s.trigger(ActionDump)
+		case <-s.ctx.Done():
+			return
 		}
 	}
 }
 
 func (s *CoreService) packagesInstall(switchConfig sd.SwitchConfig) {
 	for name, service := range switchConfig.Services {
-		if currentState, ok := s.services[name]; ok {
+		if s.ctx.Err() != nil {
+			rlog.Warn("Shutting down, skip the installation of " + name)
+			continue
+		}
+		if service.PackageName == core.CorePackage {
+			rlog.Warn("Package " + name + " is updated by the core update command, skip it")
+			continue
+		}
+		currentState, ok := s.services[name]
+		if !ok {
+			currentState, ok = s.services[service.PackageName]
+		}
+		if ok {
 			if currentState.Version == service.Version {
 				rlog.Info("Package " + name + " already in version " + service.Version + " skip it")
 				continue
@@ -262,9 +810,25 @@ func (s *CoreService) packagesInstall(switchConfig sd.SwitchConfig) {
 		}
 		rlog.Info("Install " + name + " in version " + service.Version)
 		service.Install()
+		entry := audit.Entry{
+			Category: audit.CategoryPackage,
+			Action:   "install",
+			Target:   service.PackageName,
+			Details:  "requested version " + service.Version,
+		}
 		version := pkg.GetPackageVersion(service.PackageName)
 		if version != nil {
 			service.Version = *version
+			entry.Version = *version
+			metrics.PackageInstalls.Inc(service.PackageName, metrics.ResultSuccess)
+		} else {
+			entry.Error = "package not installed"
+			metrics.PackageInstalls.Inc(service.PackageName, metrics.ResultFailure)
+		}
+		s.audit.Record(entry)
+		if service.Name != service.PackageName {
+			//replace the entry registered at discovery
+			delete(s.services, service.PackageName)
 		}
 		s.services[service.Name] = service
 	}
@@ -273,32 +837,145 @@ func (s *CoreService) packagesInstall(switchConfig sd.SwitchConfig) {
 func (s *CoreService) packagesRemove(switchConfig sd.SwitchConfig) {
 	pkg.RemoveServices(switchConfig.Services)
 	for _, service := range switchConfig.Services {
-		if _, ok := s.services[service.Name]; ok {
-			delete(s.services, service.Name)
+		entry := audit.Entry{
+			Category: audit.CategoryPackage,
+			Action:   "remove",
+			Target:   service.PackageName,
 		}
+		//services found at discovery are registered by package name
+		for _, key := range []string{service.Name, service.PackageName} {
+			if current, ok := s.services[key]; ok {
+				entry.Version = current.Version
+				delete(s.services, key)
+			}
+		}
+		s.audit.Record(entry)
 	}
 }
 
 func (s *CoreService) systemUpdate(switchConfig sd.SwitchConfig) {
-	core.SystemUpgrade()
+	if s.ctx.Err() != nil {
+		rlog.Warn("Shutting down, skip the system upgrade")
+		return
+	}
+	entry := audit.Entry{
+		Category: audit.CategoryUpgrade,
+		Action:   "system",
+	}
+	start := time.Now()
+	err := core.SystemUpgrade()
+	metrics.UpgradeDuration.ObserveSince(start, metrics.Result(err))
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.audit.Record(entry)
 }
 
 //Run service mainloop
 func (s *CoreService) Run() error {
 	s.sendHello()
 	go s.cronDump()
+	go s.cronSchedule()
+	go s.cronConfig()
+	go s.cronIdentity()
+	go s.cronFallback()
+	go s.watchdog.Run(s.ctx)
 	for {
+		//once canceled, stop before handling any other ready event: the connections may be closed
+		if s.ctx.Err() != nil {
+			s.shutdown()
+			return nil
+		}
 		select {
+		case <-s.ctx.Done():
+			s.shutdown()
+			return nil
+
 		case serviceEvent := <-s.events:
 			switch serviceEvent {
 			case ActionDump:
+				s.checkCertificates()
+				if s.serverState == network.BrokerConnected {
+					//the update may still be installing when the server is reached
+					s.confirmUpdate()
+				}
 				if s.isConfigured {
 					s.sendDump()
 				} else {
 					s.sendHello()
+					s.checkDiscoveries(database.GetSwitchLeds(s.db, s.mac), database.GetSwitchSensors(s.db, s.mac))
 				}
+
+			case ActionFallback:
+				s.checkFallback()
+
+			case ActionSchedule:
+				s.runSchedule()
+
+			case ActionConfig:
+				s.reloadConfig()
+
+			case ActionIdentity:
+				s.checkIdentity()
+
+			case ActionCertificateTrial:
+				s.checkCertificateTrial()
+
+			case ActionCredentialsTrial:
+				s.checkCredentialsTrial()
 			}
 
+		case rejection := <-s.server.Rejections:
+			s.sendRejection(rejection)
+
+		case query := <-s.server.AuditQuery:
+			s.sendAuditEntries(query)
+
+		case cmd := <-s.server.Services:
+			s.runServiceCommand(cmd)
+
+		case rules := <-s.server.AlarmRules:
+			s.setAlarmRules(rules)
+
+		case unit := <-s.local.Heartbeats:
+			s.watchdog.Heartbeat(unit)
+
+		case event := <-s.watchdog.Events:
+			s.sendWatchdogEvent(event)
+
+		case state := <-s.local.States:
+			s.onLocalState(state)
+
+		case state := <-s.server.States:
+			s.onServerState(state)
+
+		case groups := <-s.server.Fallback:
+			s.setFallbackScenario(groups)
+
+		case sched := <-s.server.Schedule:
+			s.setSchedule(sched)
+
+		case cmd := <-s.server.Logs:
+			s.runLogCommand(cmd)
+
+		case cmd := <-s.server.Credentials:
+			s.rotateCredentials(cmd)
+
+		case delivery := <-s.server.Certificates:
+			s.installCertificate(delivery)
+
+		case req := <-s.server.CoreUpdates:
+			s.selfUpdate(req)
+
+		case req := <-s.server.Diagnostics:
+			s.collectDiagnostics(req)
+
+		case line := <-s.logs.Streamed:
+			s.sendLogLine(line)
+
+		case event := <-s.local.DriverEvents:
+			s.onDriverEvent(event)
+
 		case serverEvents := <-s.server.Events:
 			for eventType, event := range serverEvents {
 				switch eventType {
@@ -308,10 +985,13 @@ func (s *CoreService) Run() error {
 					}
 					if !s.isConfigured {
 						//a reset is performed
+						s.lastConfig = sd.SwitchConfig{}
+						s.saveServerGroups()
 						continue
 					}
 					//In this case reload == setup
 					s.friendlyName = event.FriendlyName
+					s.cacheConfiguration(event)
 					s.updateConfiguration(event)
 					s.isConfigured = true
 
@@ -329,9 +1009,9 @@ func (s *CoreService) Run() error {
 					}
 					s.packagesRemove(event)
 					s.removeConfiguration(event)
+					s.uncacheConfiguration(event)
 				}
 			}
 		}
 	}
-	return nil
 }
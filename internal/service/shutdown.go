@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlOffline = "setup/offline"
+
+	OfflineShutdown = "shutdown"
+)
+
+//SwitchOffline message sent to the server before the core service stops, when the presence
+//cannot be published
+type SwitchOffline struct {
+	Mac    string `json:"mac"`
+	Reason string `json:"reason"`
+	Date   string `json:"date"`
+}
+
+//ToJSON dump switch offline struct
+func (o SwitchOffline) ToJSON() (string, error) {
+	inrec, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+//Stop service: the main loop finishes its current operation, then the connections are closed
+func (s *CoreService) Stop() {
+	rlog.Info("Stopping SwitchCore service")
+	if s.cancel == nil {
+		//not initialized
+		return
+	}
+	s.cancel()
+
+	timeout := time.NewTimer(time.Duration(s.conf.Shutdown.Timeout) * time.Second)
+	defer timeout.Stop()
+	select {
+	case <-s.done:
+	case <-timeout.C:
+		rlog.Errorf("In-flight operation not finished after %vs, force the shutdown", s.conf.Shutdown.Timeout)
+		s.publishOffline()
+		s.close()
+	}
+	rlog.Info("SwitchCore service stopped")
+}
+
+//shutdown run by the main loop once canceled
+func (s *CoreService) shutdown() {
+	s.publishOffline()
+	s.close()
+	close(s.done)
+}
+
+//publishOffline announce the graceful stop once, by the main loop or by a forced shutdown
+func (s *CoreService) publishOffline() {
+	s.offlineOnce.Do(func() {
+		err := s.server.Presence.Offline()
+		if err != nil {
+			rlog.Error("Could not publish offline presence " + err.Error())
+			s.sendOffline(OfflineShutdown)
+		}
+	})
+}
+
+func (s *CoreService) sendOffline(reason string) {
+	offline := SwitchOffline{
+		Mac:    s.mac,
+		Reason: reason,
+		Date:   time.Now().UTC().Format(time.RFC3339),
+	}
+	dump, err := offline.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump switch offline " + err.Error())
+		return
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlOffline, dump)
+	if err != nil {
+		rlog.Errorf("Could not send offline to the server %v", err.Error())
+		return
+	}
+	rlog.Info("Offline sent to the server")
+}
+
+//close the connections once
+func (s *CoreService) close() {
+	s.closeOnce.Do(func() {
+		s.server.Disconnect()
+		s.local.Disconnect()
+		s.db.Close()
+		s.audit.Close()
+	})
+}
+
+//trigger push an action to the main loop unless the service is stopping
+func (s *CoreService) trigger(action string) {
+	select {
+	case s.events <- action:
+	case <-s.ctx.Done():
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	pkg "github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/energieip/swh200-coreservice-go/internal/update"
+	"github.com/romana/rlog"
+)
+
+const (
+	UrlUpdateResult = "update/result"
+)
+
+//selfUpdate download and verify the core package in background then hand over to the updater
+func (s *CoreService) selfUpdate(req update.Request) {
+	result := update.Result{Mac: s.mac, ID: req.ID, Version: req.Version, State: update.StateFailed}
+	state, err := update.LoadState(s.conf.Update)
+	if err != nil {
+		rlog.Error("Cannot read update state " + err.Error())
+	}
+	if s.expireUpdate(state) {
+		s.confirmUpdate()
+	}
+	if state != nil && (state.State == update.StateInstalling || state.State == update.StatePending) {
+		result.Error = "update " + state.Version + " in progress"
+		s.sendUpdateResult(result)
+		return
+	}
+	current := pkg.GetPackageVersion(core.CorePackage)
+	if current == nil {
+		result.Error = core.CorePackage + " not installed"
+		s.sendUpdateResult(result)
+		return
+	}
+	if *current == req.Version {
+		result.State = update.StateConfirmed
+		s.sendUpdateResult(result)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.updating, 0, 1) {
+		result.Error = "update already running"
+		s.sendUpdateResult(result)
+		return
+	}
+
+	next := update.State{
+		ID:              req.ID,
+		Version:         req.Version,
+		PreviousVersion: *current,
+		State:           update.StateInstalling,
+	}
+	if state != nil && state.State == update.StateConfirmed && state.Version == *current {
+		//keep the package of the running version for the rollback
+		next.PreviousFile = state.File
+	}
+	conf := s.conf.Update
+	confFile := s.confFile
+
+	go func() {
+		entry := audit.Entry{
+			Category: audit.CategoryUpgrade,
+			Action:   "download",
+			Target:   core.CorePackage,
+			Version:  req.Version,
+			Details:  "from " + *current,
+		}
+		file, err := update.Download(conf, req)
+		if err == nil {
+			next.File = file
+			next.PreviousFile, err = update.KeepPrevious(conf, *current, next.PreviousFile)
+		}
+		if err == nil {
+			next.Deadline = time.Now().Add(time.Duration(conf.HealthTimeout) * time.Second).UTC().Format(time.RFC3339)
+			err = update.SaveState(conf, next)
+		}
+		if err == nil {
+			entry.Action = "handover"
+			err = update.HandOver(confFile)
+			if err != nil {
+				next.State = update.StateFailed
+				next.Error = err.Error()
+				next.Reported = true
+				update.SaveState(conf, next)
+			}
+		}
+		if err != nil {
+			atomic.StoreInt32(&s.updating, 0)
+			rlog.Error("Cannot update " + core.CorePackage + " to " + req.Version + " " + err.Error())
+			entry.Error = err.Error()
+			s.audit.Record(entry)
+			result.Error = err.Error()
+			s.sendUpdateResult(result)
+			return
+		}
+		//the updater restarts the service, the outcome is reported by the next core
+		s.audit.Record(entry)
+		rlog.Info("Update of " + core.CorePackage + " to " + req.Version + " handed over")
+		result.State = update.StateInstalling
+		s.sendUpdateResult(result)
+	}()
+}
+
+//expireUpdate mark as failed an update the updater did not end in time, it returns true when the
+//state changed
+func (s *CoreService) expireUpdate(state *update.State) bool {
+	if state == nil || (state.State != update.StateInstalling && state.State != update.StatePending) {
+		return false
+	}
+	if !state.Expired(s.conf.Update) {
+		return false
+	}
+	rlog.Warn("Update to " + state.Version + " was not completed by the updater, mark it as failed")
+	state.State = update.StateFailed
+	state.Error = "update not completed by the updater"
+	state.Reported = false
+	err := update.SaveState(s.conf.Update, *state)
+	if err != nil {
+		rlog.Error("Cannot save update state " + err.Error())
+	}
+	return true
+}
+
+//confirmUpdate validate a pending update once the hello reached the server and report the
+//outcome of the last update
+func (s *CoreService) confirmUpdate() {
+	state, err := update.LoadState(s.conf.Update)
+	if err != nil || state == nil {
+		return
+	}
+	s.expireUpdate(state)
+	switch state.State {
+	case update.StatePending:
+		current := pkg.GetPackageVersion(core.CorePackage)
+		if current == nil || *current != state.Version {
+			return
+		}
+		//the running core must have been started by the package installation
+		started, err := time.Parse(time.RFC3339Nano, state.Started)
+		if err != nil || !s.started.After(started) {
+			return
+		}
+		state.State = update.StateConfirmed
+		if state.PreviousFile != "" && state.PreviousFile != state.File {
+			os.Remove(state.PreviousFile)
+		}
+		state.PreviousFile = ""
+		err = update.SaveState(s.conf.Update, *state)
+		if err != nil {
+			rlog.Error("Cannot confirm update " + err.Error())
+			return
+		}
+		rlog.Info("Update to " + state.Version + " confirmed")
+	case update.StateConfirmed, update.StateRolledBack, update.StateFailed:
+		if state.Reported {
+			return
+		}
+	default:
+		return
+	}
+
+	result := update.Result{
+		Mac:     s.mac,
+		ID:      state.ID,
+		Version: state.Version,
+		State:   state.State,
+		Error:   state.Error,
+	}
+	if !s.sendUpdateResult(result) {
+		return
+	}
+	s.audit.Record(audit.Entry{
+		Category: audit.CategoryUpgrade,
+		Action:   state.State,
+		Target:   core.CorePackage,
+		Version:  state.Version,
+		Details:  "previous version " + state.PreviousVersion,
+		Error:    state.Error,
+	})
+	state.Reported = true
+	err = update.SaveState(s.conf.Update, *state)
+	if err != nil {
+		rlog.Error("Cannot save update state " + err.Error())
+	}
+}
+
+func (s *CoreService) sendUpdateResult(result update.Result) bool {
+	dump, err := result.ToJSON()
+	if err != nil {
+		rlog.Error("Could not dump update result " + err.Error())
+		return false
+	}
+	err = s.server.SendCommand("/read/switch/"+s.mac+"/"+UrlUpdateResult, dump)
+	if err != nil {
+		rlog.Errorf("Could not send update result to the server %v", err.Error())
+		return false
+	}
+	return true
+}
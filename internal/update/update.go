@@ -0,0 +1,314 @@
+package update
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/romana/rlog"
+)
+
+//Update states
+const (
+	StateInstalling = "installing" //handed over to the updater
+	StatePending    = "pending"    //installed, waiting for the new core to reach the server
+	StateConfirmed  = "confirmed"
+	StateRolledBack = "rolledback"
+	StateFailed     = "failed"
+
+	stateFile   = "state.json"
+	pollPeriod  = 2 * time.Second
+	updaterUnit = "energieip-swh200-core-update"
+	aptCache    = "/var/cache/apt/archives"
+)
+
+//Request self-update requested by the server
+type Request struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	URL     string `json:"url"`    //http(s) location of the debian package
+	Sha256  string `json:"sha256"` //package checksum
+}
+
+//State self-update progress shared by the core and the updater
+type State struct {
+	ID              string `json:"id"`
+	Version         string `json:"version"`
+	File            string `json:"file"`
+	PreviousVersion string `json:"previousVersion"`
+	PreviousFile    string `json:"previousFile,omitempty"` //package kept from the previous update
+	Deadline        string `json:"deadline,omitempty"`     //RFC3339, end of the installation or of the health check
+	Started         string `json:"started,omitempty"`      //RFC3339, start of the package installation
+	State           string `json:"state"`
+	Error           string `json:"error,omitempty"`
+	Reported        bool   `json:"reported"`
+}
+
+//Result self-update outcome sent to the server
+type Result struct {
+	Mac     string `json:"mac"`
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+//ToJSON dump self-update result struct
+func (r Result) ToJSON() (string, error) {
+	inrec, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9A-Za-z.+~:-]+$`)
+
+//StatePath location of the update state
+func StatePath(conf config.UpdateConfig) string {
+	return filepath.Join(conf.Dir, stateFile)
+}
+
+//LoadState read the update state, nil when no update was run
+func LoadState(conf config.UpdateConfig) (*State, error) {
+	var state *State
+	err := core.LoadJSON(StatePath(conf), &state)
+	return state, err
+}
+
+//SaveState write the update state
+func SaveState(conf config.UpdateConfig, state State) error {
+	return core.SaveJSON(StatePath(conf), state)
+}
+
+//ValidVersion return true when version only uses the debian version characters
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+//Expired return true when the updater did not end the update in time, it crashed or was killed
+func (st State) Expired(conf config.UpdateConfig) bool {
+	deadline, err := time.Parse(time.RFC3339, st.Deadline)
+	if err != nil {
+		return true
+	}
+	//leave the updater the time to roll back
+	return time.Now().After(deadline.Add(time.Duration(conf.HealthTimeout) * time.Second))
+}
+
+//Download fetch the package and check its checksum, name and version
+func Download(conf config.UpdateConfig, req Request) (string, error) {
+	client := http.Client{
+		Timeout: time.Duration(conf.DownloadTimeout) * time.Second,
+	}
+	resp, err := client.Get(req.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("download failed: " + resp.Status)
+	}
+
+	err = os.MkdirAll(conf.Dir, 0750)
+	if err != nil {
+		return "", err
+	}
+	if !ValidVersion(req.Version) {
+		return "", errors.New("invalid version " + req.Version)
+	}
+	path := filepath.Join(conf.Dir, packageName(req.Version))
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	file.Close()
+	if err == nil && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), req.Sha256) {
+		err = errors.New("checksum mismatch")
+	}
+	if err == nil {
+		err = checkPackage(tmp, req.Version)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+//packageName file name of a core package version
+func packageName(version string) string {
+	return core.CorePackage + "_" + version + ".deb"
+}
+
+//KeepPrevious copy the package of the running version in the update directory for the rollback:
+//the known file kept by the last update, the apt cache one or a fresh download from the repository
+func KeepPrevious(conf config.UpdateConfig, version, known string) (string, error) {
+	if !ValidVersion(version) {
+		return "", errors.New("invalid running version " + version)
+	}
+	if known != "" && checkPackage(known, version) == nil {
+		return known, nil
+	}
+	path := filepath.Join(conf.Dir, packageName(version))
+	if checkPackage(path, version) == nil {
+		return path, nil
+	}
+	//apt encodes the epoch colon in the archive names
+	cached, _ := filepath.Glob(filepath.Join(aptCache, core.CorePackage+"_"+
+		strings.Replace(version, ":", "%3a", -1)+"_*.deb"))
+	for _, file := range cached {
+		if checkPackage(file, version) == nil {
+			return path, copyFile(file, path)
+		}
+	}
+	tmp, err := ioutil.TempDir(conf.Dir, "previous")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	cmd := exec.Command("apt-get", "download", core.CorePackage+"="+version)
+	cmd.Dir = tmp
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New("no package of the running version " + version + ": " + strings.TrimSpace(string(out)))
+	}
+	downloaded, _ := filepath.Glob(filepath.Join(tmp, "*.deb"))
+	if len(downloaded) != 1 {
+		return "", errors.New("no package of the running version " + version)
+	}
+	if err = checkPackage(downloaded[0], version); err != nil {
+		return "", err
+	}
+	return path, os.Rename(downloaded[0], path)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+//checkPackage check the package name and version of a debian archive
+func checkPackage(path, version string) error {
+	out, err := exec.Command("dpkg-deb", "-f", path, "Package", "Version").Output()
+	if err != nil {
+		return errors.New("invalid package: " + err.Error())
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		values := strings.SplitN(line, ":", 2)
+		if len(values) == 2 {
+			fields[strings.TrimSpace(values[0])] = strings.TrimSpace(values[1])
+		}
+	}
+	if fields["Package"] != core.CorePackage {
+		return errors.New("unexpected package " + fields["Package"])
+	}
+	if fields["Version"] != version {
+		return errors.New("unexpected version " + fields["Version"])
+	}
+	return nil
+}
+
+//HandOver start the updater in its own systemd unit so that it survives the core restart
+func HandOver(confFile string) error {
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{"--unit=" + updaterUnit, "--collect", binary, "-self-update"}
+	if confFile != "" {
+		args = append(args, "-c", confFile)
+	}
+	out, err := exec.Command("systemd-run", args...).CombinedOutput()
+	if err != nil {
+		return errors.New("systemd-run: " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+//Run install the package, wait for the new core to confirm it reached the server and reinstall
+//the previous version otherwise. It is run by the updater process.
+func Run(conf config.UpdateConfig) error {
+	state, err := LoadState(conf)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.State != StateInstalling {
+		return errors.New("no update to install")
+	}
+
+	//the package restarts the core during its installation, the new core confirms a pending state
+	//started before it
+	started := time.Now()
+	deadline := started.Add(time.Duration(conf.HealthTimeout) * time.Second)
+	state.State = StatePending
+	state.Started = started.UTC().Format(time.RFC3339Nano)
+	state.Deadline = deadline.UTC().Format(time.RFC3339)
+	if err = SaveState(conf, *state); err != nil {
+		return err
+	}
+
+	rlog.Info("Install " + state.File)
+	out, err := exec.Command("dpkg", "-i", state.File).CombinedOutput()
+	if err != nil {
+		state.Error = "install: " + err.Error() + " " + strings.TrimSpace(string(out))
+		return rollback(conf, state)
+	}
+
+	for time.Now().Before(deadline) {
+		time.Sleep(pollPeriod)
+		current, err := LoadState(conf)
+		if err == nil && current != nil && current.State == StateConfirmed {
+			rlog.Info("Update " + state.Version + " confirmed")
+			return nil
+		}
+	}
+	state.Error = "the new version did not reach the server in time"
+	return rollback(conf, state)
+}
+
+//rollback reinstall the package of the previous version
+func rollback(conf config.UpdateConfig, state *State) error {
+	rlog.Error("Update " + state.Version + " failed, reinstall " + state.PreviousVersion + ": " + state.Error)
+	out, err := exec.Command("dpkg", "-i", state.PreviousFile).CombinedOutput()
+	state.State = StateRolledBack
+	if err != nil {
+		state.State = StateFailed
+		state.Error += ", rollback: " + err.Error() + " " + strings.TrimSpace(string(out))
+		//at least restart the installed core
+		core.ServiceAction(core.CorePackage, "restart")
+	}
+	state.Reported = false
+	return SaveState(conf, *state)
+}
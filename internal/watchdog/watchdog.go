@@ -0,0 +1,233 @@
+package watchdog
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/romana/rlog"
+)
+
+//Watchdog event types
+const (
+	EventUnhealthy = "unhealthy"
+	EventRestarted = "restarted"
+	EventRecovered = "recovered"
+	EventEscalated = "escalated"
+
+	activeState = "active"
+)
+
+//Event watchdog state change of a supervised service
+type Event struct {
+	Mac      string `json:"mac"`
+	Unit     string `json:"unit"`
+	Type     string `json:"type"`
+	Failures int    `json:"failures"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+//ToJSON dump watchdog event struct
+func (e Event) ToJSON() (string, error) {
+	inrec, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return string(inrec[:]), err
+}
+
+type serviceState struct {
+	config.WatchedService
+	lastHeartbeat time.Time
+	unhealthy     bool
+	reason        string
+	failures      int
+	nextRestart   time.Time
+	escalated     bool
+	paused        bool //stopped or disabled on purpose
+}
+
+//Watchdog supervise driver services and restart them when unhealthy
+type Watchdog struct {
+	Events   chan Event
+	conf     config.WatchdogConfig
+	services map[string]*serviceState
+	mutex    sync.Mutex
+}
+
+//NewWatchdog create a watchdog for the configured services
+func NewWatchdog(conf config.WatchdogConfig) *Watchdog {
+	w := Watchdog{
+		Events:   make(chan Event, len(conf.Services)*4),
+		conf:     conf,
+		services: make(map[string]*serviceState),
+	}
+	now := time.Now()
+	for _, service := range conf.Services {
+		w.services[service.Unit] = &serviceState{
+			WatchedService: service,
+			lastHeartbeat:  now,
+		}
+	}
+	return &w
+}
+
+//Heartbeat record a heartbeat received from a service
+func (w *Watchdog) Heartbeat(unit string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if state, ok := w.services[unit]; ok {
+		state.lastHeartbeat = time.Now()
+	}
+}
+
+//Pause stop supervising a service stopped or disabled on purpose
+func (w *Watchdog) Pause(unit string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if state, ok := w.services[unit]; ok {
+		state.paused = true
+		state.unhealthy = false
+		state.failures = 0
+		state.escalated = false
+	}
+}
+
+//Resume supervise again a paused service
+func (w *Watchdog) Resume(unit string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if state, ok := w.services[unit]; ok && state.paused {
+		state.paused = false
+		state.lastHeartbeat = time.Now()
+	}
+}
+
+//Unhealthy return the unhealthy services with the reason
+func (w *Watchdog) Unhealthy() map[string]config.WatchedService {
+	unhealthy := make(map[string]config.WatchedService)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for unit, state := range w.services {
+		if state.unhealthy {
+			unhealthy[unit] = state.WatchedService
+		}
+	}
+	return unhealthy
+}
+
+//Run check the services periodically until ctx is canceled, run it in its own goroutine
+func (w *Watchdog) Run(ctx context.Context) {
+	if w.conf.Period <= 0 || len(w.services) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(w.conf.Period) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for unit := range w.services {
+			if ctx.Err() != nil {
+				return
+			}
+			w.check(unit)
+		}
+	}
+}
+
+func (w *Watchdog) check(unit string) {
+	w.mutex.Lock()
+	paused := w.services[unit].paused
+	w.mutex.Unlock()
+	if paused {
+		return
+	}
+	reason := ""
+	health, err := core.GetServiceHealth(unit)
+	if err != nil {
+		reason = "systemd: " + err.Error()
+	} else if health.ActiveState != activeState {
+		reason = "service " + health.ActiveState
+	}
+
+	w.mutex.Lock()
+	state := w.services[unit]
+	now := time.Now()
+	timeout := time.Duration(state.HeartbeatTimeout) * time.Second
+	if reason == "" && timeout > 0 && now.Sub(state.lastHeartbeat) > timeout {
+		reason = "missing heartbeat"
+	}
+
+	if reason == "" {
+		recovered := state.unhealthy
+		state.unhealthy = false
+		state.reason = ""
+		state.failures = 0
+		state.escalated = false
+		w.mutex.Unlock()
+		if recovered {
+			w.notify(Event{Unit: unit, Type: EventRecovered})
+		}
+		return
+	}
+
+	if !state.unhealthy {
+		state.unhealthy = true
+		state.reason = reason
+		state.nextRestart = now
+		w.mutex.Unlock()
+		w.notify(Event{Unit: unit, Type: EventUnhealthy, Reason: reason})
+		w.mutex.Lock()
+	}
+	if now.Before(state.nextRestart) {
+		w.mutex.Unlock()
+		return
+	}
+	state.failures++
+	state.nextRestart = now.Add(w.backoff(state.failures))
+	state.lastHeartbeat = now
+	failures := state.failures
+	escalate := w.conf.MaxFailures > 0 && failures >= w.conf.MaxFailures && !state.escalated
+	if escalate {
+		state.escalated = true
+	}
+	w.mutex.Unlock()
+
+	rlog.Warnf("Watchdog: restart %v (%v), attempt %v", unit, reason, failures)
+	_, err = core.ServiceAction(unit, "restart")
+	event := Event{Unit: unit, Type: EventRestarted, Failures: failures, Reason: reason}
+	if err != nil {
+		event.Reason = reason + ", restart failed: " + err.Error()
+	}
+	w.notify(event)
+	if escalate {
+		w.notify(Event{Unit: unit, Type: EventEscalated, Failures: failures, Reason: reason})
+	}
+}
+
+//backoff return the delay before the next restart attempt
+func (w *Watchdog) backoff(failures int) time.Duration {
+	delay := time.Duration(w.conf.Period) * time.Second
+	max := time.Duration(w.conf.BackoffMax) * time.Second
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (w *Watchdog) notify(event Event) {
+	select {
+	case w.Events <- event:
+	default:
+		rlog.Error("Watchdog: drop " + event.Type + " event for " + event.Unit)
+	}
+}
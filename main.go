@@ -1,25 +1,170 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/energieip/common-service-go/pkg/service"
+	"github.com/energieip/swh200-coreservice-go/internal/audit"
+	"github.com/energieip/swh200-coreservice-go/internal/config"
+	"github.com/energieip/swh200-coreservice-go/internal/core"
+	"github.com/energieip/swh200-coreservice-go/internal/diagnostics"
+	"github.com/energieip/swh200-coreservice-go/internal/secrets"
 	coreService "github.com/energieip/swh200-coreservice-go/internal/service"
+	"github.com/energieip/swh200-coreservice-go/internal/update"
 )
 
+func printAudit(confFile string, query audit.Query) error {
+	conf, err := config.ReadCoreConfig(confFile)
+	if err != nil {
+		return err
+	}
+	entries, err := audit.Read(conf.Audit, query)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(line))
+	}
+	return nil
+}
+
+func writeDiagnostics(confFile, path string) error {
+	var units []string
+	for name := range core.GetInstalledPackages() {
+		units = append(units, name)
+	}
+	archive, err := diagnostics.Collect(diagnostics.Sources{
+		ConfigFile: confFile,
+		Units:      units,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, archive, 0600)
+}
+
+func setSecret(confFile, name string) error {
+	conf, err := config.ReadCoreConfig(confFile)
+	if err != nil {
+		return err
+	}
+	keystore, err := secrets.OpenKeystore(conf.Secrets)
+	if err != nil {
+		return err
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return keystore.Set(name, strings.TrimRight(value, "\r\n"))
+}
+
+func deleteSecret(confFile, name string) error {
+	conf, err := config.ReadCoreConfig(confFile)
+	if err != nil {
+		return err
+	}
+	keystore, err := secrets.OpenKeystore(conf.Secrets)
+	if err != nil {
+		return err
+	}
+	if _, ok := keystore.Get(name); !ok {
+		return errors.New("no keystore entry " + name)
+	}
+	return keystore.Delete(name)
+}
+
+func selfUpdate(confFile string) error {
+	conf, err := config.ReadCoreConfig(confFile)
+	if err != nil {
+		return err
+	}
+	return update.Run(conf.Update)
+}
+
 func main() {
 	var confFile string
 	var service service.IService
+	var showAudit bool
+	var auditQuery audit.Query
+	var diagnosticsFile string
+	var secretName string
+	var deletedSecret string
+	var runUpdate bool
 
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	flag.StringVar(&confFile, "config", "", "Specify an alternate configuration file.")
 	flag.StringVar(&confFile, "c", "", "Specify an alternate configuration file.")
+	flag.BoolVar(&showAudit, "audit", false, "Print the audit log and exit.")
+	flag.StringVar(&auditQuery.Since, "audit-since", "", "Print audit entries since this RFC3339 date.")
+	flag.StringVar(&auditQuery.Category, "audit-category", "", "Print audit entries of this category only.")
+	flag.IntVar(&auditQuery.Limit, "audit-limit", 0, "Print the last audit entries only.")
+	flag.StringVar(&secretName, "secret-set", "", "Store the value read on stdin in the keystore entry and exit.")
+	flag.StringVar(&deletedSecret, "secret-delete", "", "Remove the keystore entry and exit.")
+	flag.StringVar(&diagnosticsFile, "diagnostics", "", "Write a diagnostics archive (tar.gz) to this file and exit.")
+	flag.BoolVar(&runUpdate, "self-update", false, "Install the downloaded core package, roll back when the new version fails and exit.")
 	flag.Parse()
 
+	if showAudit {
+		err := printAudit(confFile, auditQuery)
+		if err != nil {
+			log.Println("Cannot read audit log " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if secretName != "" {
+		err := setSecret(confFile, secretName)
+		if err != nil {
+			log.Println("Cannot store secret " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if deletedSecret != "" {
+		err := deleteSecret(confFile, deletedSecret)
+		if err != nil {
+			log.Println("Cannot delete secret " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if diagnosticsFile != "" {
+		err := writeDiagnostics(confFile, diagnosticsFile)
+		if err != nil {
+			log.Println("Cannot build diagnostics archive " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if runUpdate {
+		err := selfUpdate(confFile)
+		if err != nil {
+			log.Println("Self-update failed " + err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	s := coreService.CoreService{}
 	service = &s
 	err := service.Initialize(confFile)
@@ -27,14 +172,23 @@ func main() {
 		log.Println("Error during service connexion " + err.Error())
 		os.Exit(1)
 	}
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		log.Println("Received SIGTERM")
+		//Run returns once the shutdown is done, exit here when it is stuck
 		service.Stop()
 		os.Exit(0)
 	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Received SIGHUP")
+			s.Reload()
+		}
+	}()
 
 	err = service.Run()
 	if err != nil {